@@ -0,0 +1,181 @@
+package caldavsms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Account - учетная запись CalDAV со своими календарями
+// Незаданные Calendars, Sender и Location берутся из общей конфигурации
+type Account struct {
+	Username  string
+	Password  string
+	Calendars []string
+	Sender    Sender
+	Location  string
+}
+
+// AccountError - ошибка синхронизации учетной записи
+type AccountError struct {
+	Account string
+	Err     error
+}
+
+func (e *AccountError) Error() string {
+	return "учетная запись " + e.Account + ": " + e.Err.Error()
+}
+
+func (e *AccountError) Unwrap() error {
+	return e.Err
+}
+
+// MultiSyncer выполняет синхронизацию нескольких учетных записей одного CalDAV-сервера
+// Состояние каждой учетной записи хранится в отдельном подкаталоге хранилища
+type MultiSyncer struct {
+	accounts []string
+	syncers  []*Syncer
+}
+
+// Функция проверяет, что имя можно использовать как подкаталог хранилища, не выходя за его пределы
+func validStorageDir(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, "/\\:\x00") && filepath.Base(name) == name
+}
+
+// Функция возвращает MultiSyncer для учетных записей accounts с общей конфигурацией base
+func NewMultiSyncer(base Config, accounts []Account) (*MultiSyncer, error) {
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("Не заданы учетные записи")
+	}
+	m := &MultiSyncer{}
+	seen := make(map[string]bool, len(accounts))
+	for _, a := range accounts {
+		if a.Username == "" {
+			return nil, fmt.Errorf("Не задано имя пользователя учетной записи")
+		}
+		if !validStorageDir(a.Username) {
+			return nil, fmt.Errorf("Имя пользователя учетной записи '%v' не может быть именем каталога хранилища", a.Username)
+		}
+		// каталоги хранилища сравниваются без учета регистра: файловая система может его не различать
+		key := strings.ToLower(a.Username)
+		if seen[key] {
+			return nil, fmt.Errorf("Учетная запись %v задана несколько раз", a.Username)
+		}
+		seen[key] = true
+		cfg := base
+		cfg.Username = a.Username
+		cfg.Password = a.Password
+		cfg.StorageName = filepath.Join(base.StorageName, a.Username)
+		if len(a.Calendars) != 0 {
+			cfg.Calendars = a.Calendars
+		}
+		if a.Sender != nil {
+			cfg.Sender = a.Sender
+		}
+		if a.Location != "" {
+			cfg.Location = a.Location
+		}
+		s, err := NewSyncer(cfg)
+		if err != nil {
+			return nil, &AccountError{Account: a.Username, Err: err}
+		}
+		m.accounts = append(m.accounts, a.Username)
+		m.syncers = append(m.syncers, s)
+	}
+	return m, nil
+}
+
+// Функция выполняет синхронизацию всех учетных записей
+// Ошибка одной учетной записи не прерывает синхронизацию остальных,
+// ошибки возвращаются объединенными через errors.Join в виде *AccountError
+func (m *MultiSyncer) Sync(ctx context.Context) error {
+	var errs []error
+	for i, s := range m.syncers {
+		if err := s.Sync(ctx); err != nil {
+			errs = append(errs, &AccountError{Account: m.accounts[i], Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Функция возвращает время ближайшего запланированного напоминания среди всех учетных записей
+func (m *MultiSyncer) NextDue() (time.Time, bool, error) {
+	var next time.Time
+	var errs []error
+	for i, s := range m.syncers {
+		t, ok, err := s.NextDue()
+		if err != nil {
+			errs = append(errs, &AccountError{Account: m.accounts[i], Err: err})
+			continue
+		}
+		if ok && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next, !next.IsZero(), errors.Join(errs...)
+}
+
+// Функция запускает синхронизацию всех учетных записей в режиме демона, см. Syncer.Run
+// Учетная запись, которую не удалось запустить (например, хранилище заблокировано другим процессом),
+// пишется в журнал и не обслуживается; ошибка возвращается, только если не запущена ни одна учетная запись
+func (m *MultiSyncer) Run(ctx context.Context, interval time.Duration) error {
+	logger := m.syncers[0].cfg.Logger
+	started := &MultiSyncer{}
+	var errs []error
+	for i, s := range m.syncers {
+		stop, err := s.startDispatcher(ctx)
+		if err != nil {
+			err = &AccountError{Account: m.accounts[i], Err: err}
+			logger.Println(err)
+			errs = append(errs, err)
+			continue
+		}
+		defer stop()
+		started.accounts = append(started.accounts, m.accounts[i])
+		started.syncers = append(started.syncers, s)
+	}
+	if len(started.syncers) == 0 {
+		return errors.Join(errs...)
+	}
+	return run(ctx, interval, logger, started.Sync, started.NextDue)
+}
+
+// Функция записывает отчет о доставке в исходящее сообщение учетной записи, которой оно принадлежит, см. Syncer.ApplyReceipt
+func (m *MultiSyncer) ApplyReceipt(r DeliveryReceipt) (bool, error) {
+	var errs []error
+	for i, s := range m.syncers {
+		ok, err := s.ApplyReceipt(r)
+		if err != nil {
+			errs = append(errs, &AccountError{Account: m.accounts[i], Err: err})
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, errors.Join(errs...)
+}
+
+// Функция возвращает запланированные сообщения всех учетных записей, отсортированные по времени отправки
+func (m *MultiSyncer) Upcoming(f UpcomingFilter) ([]Upcoming, error) {
+	var result []Upcoming
+	var errs []error
+	for i, s := range m.syncers {
+		us, err := s.Upcoming(f)
+		if err != nil {
+			errs = append(errs, &AccountError{Account: m.accounts[i], Err: err})
+			continue
+		}
+		result = append(result, us...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].DateTime.Before(result[j].DateTime)
+	})
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[:f.Limit]
+	}
+	return result, errors.Join(errs...)
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package caldavsms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultiSyncerRunSkipsLockedAccount(t *testing.T) {
+	var logs bytes.Buffer
+	base := Config{Location: "UTC", MinTime: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), FirstToken: "token", Calendars: []string{"cal"},
+		StorageName: t.TempDir(), Sender: &testSender{}, Logger: log.New(&logs, "", 0)}
+	m, err := NewMultiSyncer(base, []Account{{Username: "a"}, {Username: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// хранилище учетной записи b занято другим процессом
+	dir := filepath.Join(base.StorageName, "b")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := m.Run(ctx, time.Hour); err != nil {
+		t.Fatalf("ошибка %v, учетная запись a должна обслуживаться", err)
+	}
+	if !strings.Contains(logs.String(), "учетная запись b: блокировка хранилища") {
+		t.Errorf("в журнале нет ошибки учетной записи b:\n%v", logs.String())
+	}
+	if strings.Count(logs.String(), "учетная запись b") != 1 {
+		t.Errorf("учетная запись b синхронизировалась:\n%v", logs.String())
+	}
+
+	// ни одна учетная запись не запущена
+	m, err = NewMultiSyncer(base, []Account{{Username: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(context.Background(), time.Hour); !errors.Is(err, ErrLocked) {
+		t.Errorf("ошибка %v, ожидается ErrLocked", err)
+	}
+	unlock()
+}
@@ -0,0 +1,120 @@
+package caldavsms
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuietPolicy - правило переноса напоминаний событий на весь день, попавших в тихие часы
+type QuietPolicy int
+
+const (
+	// Не переносить напоминания
+	QuietKeep QuietPolicy = iota
+	// Переносить напоминание на окончание тихих часов
+	QuietAfter
+	// Переносить напоминание на начало тихих часов, то есть раньше
+	QuietBefore
+)
+
+// Время суток по умолчанию для напоминаний событий на весь день
+const defaultAllDayTime = 9 * time.Hour
+
+func (p QuietPolicy) String() string {
+	switch p {
+	case QuietKeep:
+		return "none"
+	case QuietAfter:
+		return "after"
+	case QuietBefore:
+		return "before"
+	default:
+		return fmt.Sprintf("QuietPolicy(%d)", int(p))
+	}
+}
+
+// Функция разбирает правило переноса напоминаний из тихих часов: "none", "after" или "before"
+func ParseQuietPolicy(v string) (QuietPolicy, error) {
+	for _, p := range []QuietPolicy{QuietKeep, QuietAfter, QuietBefore} {
+		if p.String() == v {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Некорректное правило тихих часов '%v', допустимы none, after, before", v)
+}
+
+// Функция проверяет, является ли событие событием на весь день (DTSTART;VALUE=DATE)
+func (ev *event) isAllDay() bool {
+	return ev.AllDay || len(ev.Dtstart) == len(dateFormat)
+}
+
+// Функция возвращает время напоминания tr о повторении события, начинающемся в occurrence
+// У событий на весь день напоминания, кратные суткам, переносятся на AllDayTime дня, отсчитанного в календарных днях
+// от первого дня события (RELATED=START) или от последнего дня события (RELATED=END: окончание события - полночь
+// после последнего дня, поэтому "PT0S" означает последний день, а не следующий). Переход на летнее время не сдвигает дату.
+// Напоминания, попавшие в тихие часы, переносятся по правилу QuietPolicy
+func (ev *event) triggerTime(s *Syncer, tr *trigger, occurrence time.Time, length time.Duration) (time.Time, error) {
+	t, err := tr.parseTriggerTime(s, occurrence, length)
+	if err != nil || !ev.isAllDay() {
+		return t, err
+	}
+	if tr.isNotAbs() {
+		// смещение уже разобрано parseTriggerTime
+		delta, _ := tr.delta()
+		if delta%(24*time.Hour) == 0 {
+			day := atTimeOfDay(occurrence, 0)
+			if tr.Related == "END" {
+				// длина суток в день перехода на летнее время отличается от 24 часов, поэтому дата окончания округляется
+				if last := atTimeOfDay(occurrence.Add(length+12*time.Hour), 0).AddDate(0, 0, -1); last.After(day) {
+					day = last
+				}
+			}
+			t = atTimeOfDay(day.AddDate(0, 0, int(delta/(24*time.Hour))), s.allDayTime())
+		}
+	}
+	return s.quietShift(t), nil
+}
+
+// Функция переносит время t, попавшее в тихие часы [QuietFrom, QuietTo), по правилу QuietPolicy
+func (s *Syncer) quietShift(t time.Time) time.Time {
+	from, to := s.cfg.QuietFrom, s.cfg.QuietTo
+	if s.cfg.QuietPolicy == QuietKeep || from == to {
+		return t
+	}
+	tod := t.Sub(atTimeOfDay(t, 0))
+	var quiet bool
+	if from < to {
+		quiet = tod >= from && tod < to
+	} else {
+		quiet = tod >= from || tod < to
+	}
+	if !quiet {
+		return t
+	}
+	if s.cfg.QuietPolicy == QuietAfter {
+		c := atTimeOfDay(t, to)
+		if c.Before(t) {
+			c = atTimeOfDay(t.AddDate(0, 0, 1), to)
+		}
+		return c
+	}
+	c := atTimeOfDay(t, from)
+	if c.After(t) {
+		c = atTimeOfDay(t.AddDate(0, 0, -1), from)
+	}
+	return c
+}
+
+// Функция возвращает время суток напоминаний событий на весь день
+func (s *Syncer) allDayTime() time.Duration {
+	if s.cfg.AllDayTime == nil {
+		return defaultAllDayTime
+	}
+	return *s.cfg.AllDayTime
+}
+
+// Функция возвращает время d от начала суток t в часовом поясе t
+func atTimeOfDay(t time.Time, d time.Duration) time.Time {
+	y, m, day := t.Date()
+	return time.Date(y, m, day, int(d/time.Hour), int(d%time.Hour/time.Minute), int(d%time.Minute/time.Second), 0, t.Location())
+}
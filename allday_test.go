@@ -0,0 +1,45 @@
+package caldavsms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllDayTriggerTime(t *testing.T) {
+	s := newTestSyncer(t, func(cfg *Config) { cfg.Location = "Europe/Berlin" })
+	berlin := s.location
+	at := func(y int, m time.Month, d, h int) time.Time { return time.Date(y, m, d, h, 0, 0, 0, berlin) }
+	tests := []struct {
+		name    string
+		dtstart string
+		dtend   string
+		trigger trigger
+		want    time.Time
+	}{
+		{"начало события", "20250305", "", trigger{Trigger: "PT0S"}, at(2025, 3, 5, 9)},
+		{"за день до начала", "20250305", "", trigger{Trigger: "-P1D"}, at(2025, 3, 4, 9)},
+		{"окончание однодневного события", "20250305", "", trigger{Trigger: "PT0S", Related: "END"}, at(2025, 3, 5, 9)},
+		{"окончание трехдневного события", "20250305", "20250308", trigger{Trigger: "PT0S", Related: "END"}, at(2025, 3, 7, 9)},
+		{"за день до окончания", "20250305", "20250308", trigger{Trigger: "-P1D", Related: "END"}, at(2025, 3, 6, 9)},
+		{"время суток не переносится", "20250305", "", trigger{Trigger: "-PT15H"}, at(2025, 3, 4, 9)},
+		// 30 марта 2025 в Берлине переход на летнее время: сутки длиннее или короче 24 часов не сдвигают дату
+		{"за день до начала после перехода", "20250331", "", trigger{Trigger: "-P1D"}, at(2025, 3, 30, 9)},
+		{"за неделю до начала через переход", "20250402", "", trigger{Trigger: "-P1W"}, at(2025, 3, 26, 9)},
+		{"окончание в день перехода", "20250330", "20250331", trigger{Trigger: "PT0S", Related: "END"}, at(2025, 3, 30, 9)},
+		{"окончание после перехода", "20250329", "20250331", trigger{Trigger: "P1D", Related: "END"}, at(2025, 3, 31, 9)},
+	}
+	for _, tt := range tests {
+		ev := event{Uid: tt.name, Dtstart: tt.dtstart, Dtend: tt.dtend, AllDay: true}
+		occurrence, length, err := ev.bounds(s)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		got, err := ev.triggerTime(s, &tt.trigger, occurrence, length)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%v: %v, ожидается %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package caldavsms
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Каналы доставки напоминаний; канал получателя определяется по префиксу адреса
+const (
+	ChannelSMS      = "sms"
+	ChannelTelegram = "tg"
+	ChannelEmail    = "mailto"
+	ChannelMatrix   = "matrix"
+)
+
+// Префиксы адресов получателей в описании события
+var channelPrefixes = []string{"tg:", "telegram:", "mailto:", "email:", "matrix:"}
+
+var (
+	telegramChatRe = regexp.MustCompile(`^(-?[0-9]+|@[A-Za-z0-9_]{5,})$`)
+	matrixIdRe     = regexp.MustCompile(`^[@!][^:\s]+:[^\s,;]+$`)
+)
+
+// Функция разбирает адрес получателя: номер телефона, tg:<chat_id или @username>, mailto:<адрес>
+// или идентификатор Matrix @user:server (!room:server для комнаты). Возвращает адрес в каноническом виде
+// с префиксом канала (номер телефона - без префикса) или пустую строку, если адрес некорректен
+func parseRecipient(p string) string {
+	p = strings.TrimSpace(p)
+	if scheme, addr, ok := strings.Cut(p, ":"); ok {
+		addr = strings.TrimSpace(addr)
+		switch strings.ToLower(scheme) {
+		case "tg", "telegram":
+			if telegramChatRe.MatchString(addr) {
+				return ChannelTelegram + ":" + addr
+			}
+			return ""
+		case "mailto", "email":
+			if i := strings.IndexByte(addr, '?'); i >= 0 {
+				addr = addr[:i]
+			}
+			a, err := mail.ParseAddress(addr)
+			if err != nil {
+				return ""
+			}
+			return ChannelEmail + ":" + a.Address
+		case "matrix":
+			p = addr
+		}
+	}
+	if matrixIdRe.MatchString(p) {
+		return p
+	}
+	return parsePhone(p)
+}
+
+// Функция возвращает канал доставки и адрес без префикса канала для адреса получателя
+func channelOf(addr string) (string, string) {
+	if v, ok := strings.CutPrefix(addr, ChannelTelegram+":"); ok {
+		return ChannelTelegram, v
+	}
+	if v, ok := strings.CutPrefix(addr, ChannelEmail+":"); ok {
+		return ChannelEmail, v
+	}
+	if strings.HasPrefix(addr, "@") || strings.HasPrefix(addr, "!") {
+		return ChannelMatrix, addr
+	}
+	return ChannelSMS, addr
+}
+
+// Функция делит список получателей описания события и текст сообщения
+// Получатели разделяются запятой или точкой с запятой, список заканчивается двоеточием;
+// двоеточия префиксов каналов (tg:, mailto:) и идентификаторов Matrix (@user:server) разделителем не считаются.
+// Второе значение - текст после списка, третье равно false, если двоеточие после списка не найдено
+func splitRecipients(s string) ([]string, string, bool) {
+	var result []string
+	for {
+		s = strings.TrimLeft(s, " ")
+		prefix := ""
+		for _, p := range channelPrefixes {
+			if len(s) >= len(p) && strings.EqualFold(s[:len(p)], p) {
+				prefix, s = s[:len(p)], s[len(p):]
+				break
+			}
+		}
+		end := strings.IndexAny(s, ",;:")
+		if end < 0 {
+			return nil, "", false
+		}
+		token := strings.TrimSpace(s[:end])
+		if s[end] == ':' && (prefix == "" || strings.EqualFold(prefix, "matrix:")) && (strings.HasPrefix(token, "@") || strings.HasPrefix(token, "!")) {
+			// идентификатор Matrix: двоеточие отделяет имя сервера
+			server := strings.IndexAny(s[end+1:], ",;: ")
+			if server < 0 {
+				return nil, "", false
+			}
+			token = s[:end+1+server]
+			s = strings.TrimLeft(s[end+1+server:], " ")
+			if s == "" || !strings.ContainsRune(",;:", rune(s[0])) {
+				return nil, "", false
+			}
+			end = 0
+		}
+		result = append(result, prefix+token)
+		if s[end] == ':' {
+			return result, s[end+1:], true
+		}
+		s = s[end+1:]
+	}
+}
+
+// ChannelSender направляет сообщения в шлюз канала получателя: SMS, Telegram, электронная почта или Matrix
+// Шлюзу канала передается адрес без префикса канала. Ограничения скорости выдерживаются шлюзом канала.
+type ChannelSender struct {
+	SMS      Sender
+	Telegram Sender
+	Email    Sender
+	Matrix   Sender
+}
+
+// Шлюз, направляющий сообщение в другой шлюз в зависимости от получателя
+type router interface {
+	route(phone string) (Sender, string, error)
+}
+
+func (c *ChannelSender) route(addr string) (Sender, string, error) {
+	channel, to := channelOf(addr)
+	sender := map[string]Sender{ChannelSMS: c.SMS, ChannelTelegram: c.Telegram, ChannelEmail: c.Email, ChannelMatrix: c.Matrix}[channel]
+	if sender == nil {
+		return nil, to, fmt.Errorf("Не задан шлюз канала %v для получателя %v", channel, addr)
+	}
+	return sender, to, nil
+}
+
+func (c *ChannelSender) Send(ctx context.Context, phone, text string) (*Delivery, error) {
+	sender, to, err := c.route(phone)
+	if err != nil {
+		return nil, err
+	}
+	return sender.Send(ctx, to, text)
+}
+
+// Функция возвращает количество одновременных отправок шлюза SMS
+// Очередь общая для всех каналов, поэтому одновременных отправок не может быть больше, чем допускает шлюз SMS
+func (c *ChannelSender) Concurrency() int {
+	if cs, ok := c.SMS.(concurrent); ok && cs.Concurrency() > 1 {
+		return cs.Concurrency()
+	}
+	return 1
+}
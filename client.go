@@ -2,16 +2,22 @@ package caldavsms
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	dac "github.com/Snawoot/go-http-digest-auth-client"
 	iso8601 "github.com/dylanmei/iso8601"
+	"github.com/emersion/go-ical"
 	"github.com/emersion/go-webdav/caldav"
 	db "github.com/sonyarouje/simdb"
 	"github.com/teambition/rrule-go"
@@ -23,12 +29,6 @@ const (
 	datetimeUTCFormat = "20060102T150405Z"
 )
 
-var (
-	dlocation   string
-	dmintime    time.Time
-	dfirsttoken string
-)
-
 type calendarItemPath struct {
 	Path     string
 	IsActual bool
@@ -41,20 +41,36 @@ type calendarItemPaths struct {
 type trigger struct {
 	Uid     string `json:"uid"`
 	Trigger string `json:"trigger"`
+	// RELATED=END - напоминание отсчитывается от окончания события (задачи)
+	Related string `json:"related"`
+	Action  string `json:"action"`
+	// Количество повторов напоминания и интервал между ними
+	Repeat   int    `json:"repeat"`
+	Duration string `json:"duration"`
+	// Номера из ATTENDEE напоминания (tel: и sms:), получают сообщение вместе с номерами из описания
+	Phones []phone `json:"phones"`
 }
 type phone struct {
 	Phone string `json:"phone"`
 }
 type exdate struct {
 	Exdate   string    `json:"exdate"`
+	Tzid     string    `json:"tzid"`
 	DateTime time.Time `json:"datetime"`
 }
 type event struct {
+	Id          string     `json:"id"`
+	Calendar    string     `json:"calendar"`
+	Path        string     `json:"path"`
 	Tzid        string     `json:"tzid"`
 	Uid         string     `json:"uid"`
 	Description string     `json:"description"`
 	Reccurence  string     `json:"reccurence"`
 	Dtstart     string     `json:"dtstart"`
+	Dtend       string     `json:"dtend"`
+	Duration    string     `json:"duration"`
+	Due         string     `json:"due"`
+	AllDay      bool       `json:"allday"`
 	Exdates     *[]exdate  `json:"exdates"`
 	Rrule       string     `json:"rrule"`
 	Status      string     `json:"status"`
@@ -62,21 +78,39 @@ type event struct {
 	Triggers    *[]trigger `json:"triggers"`
 	PhonesSMS   *[]phone   `json:"phonessms"`
 	TextSMS     string     `json:"textsms"`
+	// TZID свойств RECURRENCE-ID, DTEND и DUE; TZID свойства DTSTART - в Tzid
+	ReccurenceTzid string `json:"reccurencetzid"`
+	DtendTzid      string `json:"dtendtzid"`
+	DueTzid        string `json:"duetzid"`
+	// Часовые пояса, описанные в объекте календаря
+	Timezones []timezone `json:"timezones"`
 }
 type events struct {
 	Events *[]event
 }
 type task struct {
+	Id         string    `json:"id"`
+	Calendar   string    `json:"calendar"`
 	DateTime   time.Time `json:"datetime"`
+	Occurrence time.Time `json:"occurrence"`
 	Uid        string    `json:"uid"`
 	UidTrigger string    `json:"uidtrigger"`
+	Repeat     int       `json:"repeat"`
 }
 type tasks struct {
 	Task *[]task
 }
 type message struct {
-	Phone string `json:"phone"`
-	Text  string `json:"text"`
+	Phone      string    `json:"phone"`
+	Text       string    `json:"text"`
+	Calendar   string    `json:"calendar"`
+	Uid        string    `json:"uid"`
+	UidTrigger string    `json:"uidtrigger"`
+	Repeat     int       `json:"repeat"`
+	DateTime   time.Time `json:"datetime"`
+	Occurrence time.Time `json:"occurrence"`
+	// Количество частей SMS, 0 - сообщение другого канала
+	Segments int `json:"segments"`
 }
 type props struct {
 	Id       string    `json:"id"`
@@ -85,6 +119,7 @@ type props struct {
 }
 type driver struct {
 	Driver *db.Driver
+	dir    string
 }
 type digitalAuthHTTPClient struct {
 	c httpClient
@@ -99,7 +134,15 @@ type client struct {
 }
 
 func (c *digitalAuthHTTPClient) Do(req *http.Request) (*http.Response, error) {
-	return c.c.Do(req)
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %v", ErrAuth, resp.Status)
+	}
+	return resp, nil
 }
 
 func httpClientWithDigitalAuth(c httpClient) httpClient {
@@ -110,12 +153,15 @@ func httpClientWithDigitalAuth(c httpClient) httpClient {
 }
 
 // Функция возвращает текущее время
-func getCurrentTime() (time.Time, error) {
-	currenttime := toTime(time.Now(), dlocation)
-	if dmintime.IsZero() {
-		panic("The mintime-parameter is not specified")
-	} else if currenttime.Before(dmintime) {
-		panic("The current time is less than the mintime-parameter")
+func (s *Syncer) getCurrentTime() (time.Time, error) {
+	currenttime, err := s.toTime(time.Now(), "")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if s.cfg.MinTime.IsZero() {
+		return time.Time{}, fmt.Errorf("%w: не задан параметр mintime", ErrClockBeforeMintime)
+	} else if currenttime.Before(s.cfg.MinTime) {
+		return time.Time{}, fmt.Errorf("%w: %v < %v", ErrClockBeforeMintime, currenttime, s.cfg.MinTime)
 	} else {
 		return currenttime, nil
 	}
@@ -128,41 +174,100 @@ func initDriver(storagename string) (*driver, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &driver{Driver: d}, nil
+	return &driver{Driver: d, dir: storagename}, nil
 }
 
-func (d *driver) writePropsDB(t time.Time, token string) error {
-	db := &props{DateTime: t, Token: token, Id: "0"}
+// Функция заменяет все записи сущности в хранилище записями entities (срез сущностей одного типа)
+// simdb перезаписывает файл сущности при каждой вставке и удалении записи, поэтому массовые изменения
+// выполняются в памяти и записываются одной операцией. Файл заменяется целиком, прерванная запись его не портит.
+func (driver *driver) writeAllDB(entities interface{}) error {
+	v := reflect.ValueOf(entities)
+	b := []byte("[]")
+	if v.Len() > 0 {
+		var err error
+		if b, err = json.MarshalIndent(entities, "", "\t"); err != nil {
+			return fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+	}
+	// имя файла совпадает с именем, которое simdb выводит из типа сущности
+	file := filepath.Join(driver.dir, v.Type().Elem().Name())
+	f, err := os.OpenFile(file+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	return nil
+}
+
+// Идентификатор параметров синхронизации в хранилище до поддержки нескольких календарей
+const legacyPropsId = "0"
+
+// Функция возвращает ключ события в хранилище: путь к календарю и UID,
+// чтобы одинаковые UID из разных календарей не пересекались
+func eventKey(calendarpath, uid string) string {
+	return calendarpath + uid
+}
+
+// Функция возвращает ключ напоминания в хранилище: событие, напоминание (VALARM), начало повторения события
+// и номер повтора напоминания (REPEAT), если это не первая отправка
+func taskKey(calendarpath, uid, uidTrigger string, occurrence time.Time, repeat int) string {
+	key := eventKey(calendarpath, uid) + "|" + uidTrigger + "|" + occurrence.UTC().Format(datetimeUTCFormat)
+	if repeat > 0 {
+		key += fmt.Sprintf("|%v", repeat)
+	}
+	return key
+}
+
+// Функция выполняет запись параметров синхронизации календаря в хранилище
+func (d *driver) writePropsDB(calendarpath string, t time.Time, token string) error {
+	db := &props{DateTime: t, Token: token, Id: calendarpath}
 	if err := db.writeDB(d.Driver); err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrStorage, err)
 	}
 	return nil
 }
 
-// Функция возвращает из хранилища предыдущую дату синхронизации и токен
+// Функция возвращает из хранилища предыдущую дату синхронизации и токен календаря
 // В случае, если в хранилище нет информации, создает новые данные
-// время - текущее время, токен - firsttoken
-func (d *driver) getPropsDB() (*props, error) {
+// время - текущее время (или время синхронизации из хранилища до поддержки нескольких календарей), токен - firsttoken
+func (d *driver) getPropsDB(s *Syncer, calendarpath string) (*props, error) {
 	var db *props
-	currenttime, err := getCurrentTime()
+	currenttime, err := s.getCurrentTime()
 	if err != nil {
 		return nil, err
 	}
 
-	if dfirsttoken == "" {
+	if s.cfg.FirstToken == "" {
 		return nil, fmt.Errorf("Не задан первоначальный токен синхронизации")
 	}
-	if err := d.Driver.Open(props{}).First().AsEntity(&db); err != nil {
-		db = &props{DateTime: currenttime, Token: dfirsttoken, Id: "0"}
+	if err := d.Driver.Open(props{}).Where("id", "=", calendarpath).First().AsEntity(&db); err != nil {
+		db = &props{DateTime: currenttime, Token: s.cfg.FirstToken, Id: calendarpath}
+		var legacy *props
+		if err := d.Driver.Open(props{}).Where("id", "=", legacyPropsId).First().AsEntity(&legacy); err == nil &&
+			!legacy.DateTime.Before(s.cfg.MinTime) && !currenttime.Before(legacy.DateTime) {
+			// календарь загружается заново с первоначального токена, но напоминания считаются с прежнего времени
+			db.DateTime = legacy.DateTime
+		}
 		if err := db.writeDB(d.Driver); err != nil {
-			return nil, err
-		} else {
-			if currenttime.Before(db.DateTime) {
-				return nil, fmt.Errorf("Время, указанное в хранилище больше, чем текущее время")
-			}
+			return nil, fmt.Errorf("%w: %v", ErrStorage, err)
 		}
-	} else if db.DateTime.Before(dmintime) {
-		return nil, fmt.Errorf("Время, указанное в хранилище меньше, чем минимальное допустимое")
+	} else if db.DateTime.Before(s.cfg.MinTime) {
+		return nil, fmt.Errorf("%w: время, указанное в хранилище меньше, чем минимальное допустимое", ErrStorage)
+	} else if currenttime.Before(db.DateTime) {
+		return nil, fmt.Errorf("%w: время, указанное в хранилище больше, чем текущее время", ErrStorage)
 	}
 	return db, nil
 }
@@ -185,8 +290,8 @@ func (sp props) ID() (jsonField string, value interface{}) {
 }
 
 // Функция принимает на вход клиента, путь к календарю и возвращает новый токен календаря
-func (cl *client) getNewCalendarToken(calendarpath string) (string, error) {
-	if token, err := cl.Client.GetToken(context.Background(), calendarpath); err != nil {
+func (cl *client) getNewCalendarToken(ctx context.Context, calendarpath string) (string, error) {
+	if token, err := cl.Client.GetToken(ctx, calendarpath); err != nil {
 		return "", err
 	} else {
 		return token, nil
@@ -195,42 +300,45 @@ func (cl *client) getNewCalendarToken(calendarpath string) (string, error) {
 
 // Функция принимает на вход интерфейс, который может принимать тип string форматов "20060102",  "20060102T150405", "20060102T150405Z"
 // или тип time.Time, и вторым - локализацию в виде строки вида "Europe/Moscow". Возвращает время в приведенном формате.
-func toTime(value interface{}, loc string) time.Time {
-	if loc == "" {
-		loc = dlocation
-	}
-	l, err := time.LoadLocation(loc)
+// Если локализация не задана, используется локализация из Config
+func (s *Syncer) toTime(value interface{}, loc string) (time.Time, error) {
+	l, err := s.loadLocation(loc)
 	if err != nil {
-		panic(err)
+		return time.Time{}, err
 	}
+	return toTimeIn(value, l)
+}
+
+// Функция переводит значение value (см. toTime) во время в часовом поясе l
+func toTimeIn(value interface{}, l *time.Location) (time.Time, error) {
 	switch v := value.(type) {
 	case string:
 		switch len(v) {
 		case 8:
 			if t, err := time.ParseInLocation(dateFormat, v, l); err != nil {
-				panic(err)
+				return time.Time{}, fmt.Errorf("%w: %v", ErrInvalidTime, err)
 			} else {
-				return t.UTC().In(l)
+				return t.UTC().In(l), nil
 			}
 		case 15:
 			if t, err := time.ParseInLocation(datetimeFormat, v, l); err != nil {
-				panic(err)
+				return time.Time{}, fmt.Errorf("%w: %v", ErrInvalidTime, err)
 			} else {
-				return t
+				return t, nil
 			}
 		case 16:
 			if t, err := time.ParseInLocation(datetimeUTCFormat, v, time.UTC); err != nil {
-				panic(err)
+				return time.Time{}, fmt.Errorf("%w: %v", ErrInvalidTime, err)
 			} else {
-				return t.UTC().In(l)
+				return t.UTC().In(l), nil
 			}
 		default:
-			panic("Некорректный формат строкового значения value")
+			return time.Time{}, fmt.Errorf("%w: некорректный формат строкового значения '%v'", ErrInvalidTime, v)
 		}
 	case time.Time:
-		return v.UTC().In(l)
+		return v.UTC().In(l), nil
 	default:
-		panic("Некорректный тип параметра value")
+		return time.Time{}, fmt.Errorf("%w: некорректный тип параметра value", ErrInvalidTime)
 	}
 }
 
@@ -247,36 +355,52 @@ func newClient(username, password, uri string) (*client, error) {
 	}
 }
 
-// Функция получает на вход клиента, имя календаря и возвращает путь к календарю
-func (cl *client) getCalendarPath(calendarname string) (string, error) {
-	principal, err := cl.Client.FindCurrentUserPrincipal(context.Background())
+// Имя календаря, означающее все календари пользователя
+const AllCalendars = "*"
+
+// Функция получает на вход клиента, имена календарей и возвращает пути к календарям
+// Если среди имен есть AllCalendars, возвращаются пути ко всем календарям пользователя
+func (cl *client) getCalendarPaths(ctx context.Context, calendarnames []string) ([]string, error) {
+	principal, err := cl.Client.FindCurrentUserPrincipal(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	homeSet, err := cl.Client.FindCalendarHomeSet(context.Background(), principal)
+	homeSet, err := cl.Client.FindCalendarHomeSet(ctx, principal)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	calendars, err := cl.Client.FindCalendars(context.Background(), homeSet)
+	calendars, err := cl.Client.FindCalendars(ctx, homeSet)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	var cal caldav.Calendar
-	for _, c := range calendars {
-		if c.Name == calendarname {
-			cal = c
+	var paths []string
+	for _, name := range calendarnames {
+		if name == AllCalendars {
+			paths = paths[:0]
+			for _, c := range calendars {
+				paths = append(paths, c.Path)
+			}
+			return paths, nil
 		}
 	}
-	if cal.Path == "" {
-		msg := "Не найден календарь с именем '" + calendarname + "'"
-		return "", fmt.Errorf("%v", msg)
+	for _, name := range calendarnames {
+		var path string
+		for _, c := range calendars {
+			if c.Name == name {
+				path = c.Path
+			}
+		}
+		if path == "" {
+			return nil, fmt.Errorf("%w: не найден календарь с именем '%v'", ErrCalendarNotFound, name)
+		}
+		paths = append(paths, path)
 	}
-	return cal.Path, nil
+	return paths, nil
 }
 
 // Функция получает на вход клиента, путь к календарю, токен и возвращает ссылку на слайс путей к событиям календаря
-func (cl *client) getCalendarChanges(calendarpath, token string) (*calendarItemPaths, error) {
-	ms, err := cl.Client.GetCalendarChanges(context.Background(), calendarpath, token)
+func (cl *client) getCalendarChanges(ctx context.Context, calendarpath, token string) (*calendarItemPaths, error) {
+	ms, err := cl.Client.GetCalendarChanges(ctx, calendarpath, token)
 	if err != nil {
 		return nil, err
 	}
@@ -301,21 +425,22 @@ func (cl *client) getCalendarChanges(calendarpath, token string) (*calendarItemP
 
 // Функция выполняет удаление только "плохих" путей
 func (cs *calendarItemPaths) deleteNotActualPathsDB(driver *driver) error {
+	keys := make(map[string]bool)
 	for _, c := range *cs.CalendarItemPaths {
 		if !c.IsActual && c.Path != "" {
 			uid := c.Path[len(*cs.CalendarPath) : len(c.Path)-len(".ics")]
-			e := event{Uid: uid}
-			e.DeleteDB(driver)
-			m := task{Uid: uid}
-			m.DeleteDB(driver)
+			keys[eventKey(*cs.CalendarPath, uid)] = true
 		}
 	}
-	return nil
+	if err := driver.replaceEventsDB(keys, nil); err != nil {
+		return err
+	}
+	return driver.deleteTasksDB(keys)
 }
 
 // Функция по слайсу ссылок на календарь идет на сервер caldav, получает объекты и возвращает их в виде *Events
 // В этой функции стоит фильтр, чтобы не брались события, которые удалены
-func (cs *calendarItemPaths) getEvents() (*events, error) {
+func (cs *calendarItemPaths) getEvents(ctx context.Context, s *Syncer) (*events, error) {
 	var paths []string
 	for _, c := range *cs.CalendarItemPaths {
 		if c.IsActual {
@@ -323,36 +448,42 @@ func (cs *calendarItemPaths) getEvents() (*events, error) {
 		}
 	}
 	if len(paths) != 0 {
-		mc, err := cs.Client.Client.MultiGetCalendar(context.Background(), *cs.CalendarPath, &caldav.CalendarMultiGet{Paths: paths})
+		mc, err := cs.Client.Client.MultiGetCalendar(ctx, *cs.CalendarPath, &caldav.CalendarMultiGet{Paths: paths})
 		if err != nil {
 			return nil, err
 		}
 		var evs []event
 		for _, ical := range mc {
-			var tzid string
+			// часовые пояса, описанные в объекте, используются, если TZID нет в базе часовых поясов
+			var timezones []timezone
 			for _, e := range ical.Data.Component.Children {
-				if e.Name == "VTIMEZONE" {
-					tzid = e.Props.Get("TZID").Value
+				if e.Name == "VTIMEZONE" && e.Props.Get("TZID") != nil {
+					if tz, err := parseVTimezone(e); err == nil {
+						timezones = append(timezones, tz)
+					}
 				}
-				if e.Name == "VEVENT" || e.Name == "VTODO" {
+			}
+			for _, e := range ical.Data.Component.Children {
+				if (e.Name == "VEVENT" || e.Name == "VTODO") && e.Props.Get("UID") != nil {
 					uid := e.Props.Get("UID").Value
 					var description string
 					if e.Props.Get("DESCRIPTION") != nil {
 						description = e.Props.Get("DESCRIPTION").Value
 					}
-					var recurrence string
-					if e.Props.Get("RECURRENCE-ID") != nil {
-						recurrence = e.Props.Get("RECURRENCE-ID").Value
-					}
-					var dtstart string
-					if e.Props.Get("DTSTART") != nil {
-						dtstart = e.Props.Get("DTSTART").Value
+					recurrence, recurrenceTzid := propTime(e, "RECURRENCE-ID")
+					dtstart, tzid := propTime(e, "DTSTART")
+					allDay := e.Props.Get("DTSTART") != nil && e.Props.Get("DTSTART").Params.Get("VALUE") == "DATE"
+					dtend, dtendTzid := propTime(e, "DTEND")
+					due, dueTzid := propTime(e, "DUE")
+					var duration string
+					if e.Props.Get("DURATION") != nil {
+						duration = e.Props.Get("DURATION").Value
 					}
 					var exdates []exdate
-					if e.Props.Get("EXDATE") != nil {
-						for _, ex := range e.Props.Values("EXDATE") {
-							s := exdate{Exdate: ex.Value}
-							exdates = append(exdates, s)
+					for _, ex := range e.Props.Values("EXDATE") {
+						// в одном свойстве EXDATE может быть несколько дат через запятую
+						for _, v := range strings.Split(ex.Value, ",") {
+							exdates = append(exdates, exdate{Exdate: v, Tzid: ex.Params.Get("TZID")})
 						}
 					}
 					var rrule string
@@ -363,14 +494,30 @@ func (cs *calendarItemPaths) getEvents() (*events, error) {
 					if e.Props.Get("STATUS") != nil {
 						status = e.Props.Get("STATUS").Value
 					}
-					event := event{Tzid: tzid, Uid: uid, Description: description, Reccurence: recurrence, Dtstart: dtstart, Exdates: &exdates, Rrule: rrule, Kind: e.Name, Status: status}
+					event := event{Calendar: *cs.CalendarPath, Path: ical.Path, Tzid: tzid, Uid: uid, Description: description, Reccurence: recurrence, Dtstart: dtstart, Dtend: dtend, Duration: duration, Due: due, AllDay: allDay,
+						ReccurenceTzid: recurrenceTzid, DtendTzid: dtendTzid, DueTzid: dueTzid, Timezones: timezones, Exdates: &exdates, Rrule: rrule, Kind: e.Name, Status: status}
 					var tr []trigger
-					for _, a := range e.Children {
-						t := trigger{Uid: a.Props.Get("UID").Value, Trigger: a.Props.Get("TRIGGER").Value}
+					var err error
+					for i, a := range e.Children {
+						if a.Name != "VALARM" || a.Props.Get("TRIGGER") == nil {
+							continue
+						}
+						var t trigger
+						if t, err = parseAlarm(a, i); err != nil {
+							break
+						}
 						tr = append(tr, t)
 					}
 					event.Triggers = &tr
-					event.calc()
+					if err == nil {
+						err = event.calc(s)
+					}
+					if err != nil {
+						// некорректное событие не должно останавливать синхронизацию всего календаря:
+						// оно остается без напоминаний, ранее запланированные напоминания удаляются
+						s.cfg.Logger.Printf("Событие %v календаря %v пропущено: %v", uid, *cs.CalendarPath, err)
+						event.Triggers = &[]trigger{}
+					}
 					evs = append(evs, event)
 				}
 			}
@@ -380,8 +527,54 @@ func (cs *calendarItemPaths) getEvents() (*events, error) {
 	return &events{Events: &[]event{}}, nil
 }
 
+// Функция возвращает значение свойства даты/времени и его параметр TZID
+func propTime(c *ical.Component, name string) (string, string) {
+	p := c.Props.Get(name)
+	if p == nil {
+		return "", ""
+	}
+	return p.Value, p.Params.Get("TZID")
+}
+
+// Функция разбирает напоминание VALARM
+// n - порядковый номер напоминания в событии, используется вместо UID напоминания, если он не задан
+func parseAlarm(a *ical.Component, n int) (trigger, error) {
+	t := trigger{Uid: fmt.Sprintf("VALARM-%v", n), Trigger: a.Props.Get("TRIGGER").Value, Related: strings.ToUpper(a.Props.Get("TRIGGER").Params.Get("RELATED"))}
+	if p := a.Props.Get("UID"); p != nil {
+		t.Uid = p.Value
+	}
+	if p := a.Props.Get("ACTION"); p != nil {
+		t.Action = strings.ToUpper(p.Value)
+	}
+	if p := a.Props.Get("REPEAT"); p != nil {
+		repeat, err := strconv.Atoi(p.Value)
+		if err != nil || repeat < 0 {
+			return t, fmt.Errorf("%w: REPEAT '%v'", ErrInvalidTrigger, p.Value)
+		}
+		t.Repeat = repeat
+	}
+	if p := a.Props.Get("DURATION"); p != nil {
+		t.Duration = p.Value
+	}
+	for _, p := range a.Props.Values("ATTENDEE") {
+		// mailto: не используется: их содержат все напоминания ACTION:EMAIL (RFC 5545)
+		scheme, number, ok := strings.Cut(p.Value, ":")
+		if !ok || (!strings.EqualFold(scheme, "tel") && !strings.EqualFold(scheme, "sms")) {
+			continue
+		}
+		// параметры URI: tel:+79001234567;ext=1, sms:+79001234567?body=...
+		if i := strings.IndexAny(number, ";?"); i >= 0 {
+			number = number[:i]
+		}
+		if ph := parsePhone(number); ph != "" {
+			t.Phones = append(t.Phones, phone{Phone: ph})
+		}
+	}
+	return t, nil
+}
+
 // Функция выполняет расчет дополнительных полей event
-func (ev *event) calc() {
+func (ev *event) calc(s *Syncer) error {
 	if ev.Description != "" {
 		t, phs := ev.parseDescription()
 		ev.TextSMS = t
@@ -392,11 +585,17 @@ func (ev *event) calc() {
 		ev.PhonesSMS = &[]phone{}
 	}
 	for i, _ := range *ev.Exdates {
-		(*ev.Exdates)[i].DateTime = toTime((*ev.Exdates)[i].Exdate, "")
+		t, err := ev.toTime(s, (*ev.Exdates)[i].Exdate, (*ev.Exdates)[i].Tzid)
+		if err != nil {
+			return err
+		}
+		(*ev.Exdates)[i].DateTime = t
 	}
+	return nil
 }
 
-// Функция извлекасет из Description объекта Event текст сообщения и список номеров
+// Функция извлекасет из Description объекта Event текст сообщения и список получателей
+// Получатели - номера телефонов и адреса других каналов: tg:, mailto:, @user:server (см. parseRecipient)
 func (ev *event) parseDescription() (string, *[]phone) {
 	s := strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(ev.Description, "\\;", ";"), "\\,", ","), "\\n", " "), "\\\\", "\\"), "  ", " "), "\t", " ")
 	ss := strings.SplitN(s, ":", 3)
@@ -404,36 +603,21 @@ func (ev *event) parseDescription() (string, *[]phone) {
 		pref := strings.ToUpper(ss[0])
 		var phs []phone
 		if pref == "SMS" || pref == "СМС" {
-			re := regexp.MustCompile("[;,]")
-			spt := re.Split(ss[1], -1)
-			for _, p := range spt {
-				pp := parsePhone(p)
+			recipients, text, ok := splitRecipients(s[len(ss[0])+1:])
+			if !ok {
+				return "", &[]phone{}
+			}
+			for _, p := range recipients {
+				pp := parseRecipient(p)
 				if pp != "" {
 					pn := phone{Phone: pp}
 					phs = append(phs, pn)
 				}
 			}
+			ss[2] = text
 		}
-		re := regexp.MustCompile("[А-Яа-я]+?")
-		isRussian := re.MatchString(ss[2])
-		r := []rune(ss[2])
-		cnt := len(r)
-		var t string
-		if isRussian {
-			if cnt > 70 {
-				t = string(r[:69]) + ">"
-			} else {
-				t = string(r)
-			}
-			return t, &phs
-		} else {
-			if cnt > 160 {
-				t = string(r[:159]) + ">"
-			} else {
-				t = string(r)
-			}
-			return t, &phs
-		}
+		// длина SMS ограничивается при отправке, см. Syncer.fitSMS
+		return ss[2], &phs
 	}
 	return "", &[]phone{}
 }
@@ -458,208 +642,270 @@ func parsePhone(p string) string {
 	}
 }
 
-// Функция выполняет расчет событий, следующих после заданного в параметре времени и возвращает ссылку на Messages
-func (ev *events) calcMessages(dateTimeStartSync time.Time) *tasks {
+// Функция выполняет расчет напоминаний событий, следующих после заданного в параметре времени, и возвращает ссылку на Messages
+// Каждое напоминание (VALARM) каждого повторения события планируется отдельно: до момента dateTimeStartSync+Horizon,
+// но не менее одного ближайшего напоминания на каждый VALARM.
+// События с ошибками (RRULE, TRIGGER, часовой пояс) остаются без напоминаний с записью в журнал,
+// чтобы не останавливать синхронизацию календаря
+func (ev *events) calcMessages(s *Syncer, dateTimeStartSync time.Time) (*tasks, error) {
 	var ts []task
+	horizon := dateTimeStartSync.Add(s.cfg.Horizon)
 	if ev.Events != nil {
-		for _, e := range *ev.Events {
-			if e.isForSMS() {
-				dtstartdatetime := toTime(e.Dtstart, e.Tzid)
-				if e.Rrule != "" {
-					r, _ := rrule.StrToRRule(e.Rrule)
-					r.DTStart(dtstartdatetime)
-					triggerTimeNew := toTime("99991231T000000", e.Tzid)
-					var uidTrigger string
-					var flag bool
-				outer:
-					for _, tr := range *e.Triggers {
-						d := r.GetDTStart()
-						triggerTime := tr.parseTriggerTime(d, e.Tzid)
-						if triggerTime.After(dateTimeStartSync) {
-							if triggerTime.Before(triggerTimeNew) && ev.IsRruleDate(&e, d) {
-								flag = true
-								triggerTimeNew = triggerTime
-								uidTrigger = tr.Uid
-							}
-							if !tr.isNegative() && d.Before(dateTimeStartSync) {
-								d = dateTimeStartSync
-								for {
-									d = r.Before(d, false)
-									if d.IsZero() {
-										continue outer
-									}
-									if !ev.IsRruleDate(&e, d) {
-										continue
-									}
-									triggerTime = tr.parseTriggerTime(d, e.Tzid)
-									if triggerTime.After(dateTimeStartSync) {
-										if triggerTime.Before(triggerTimeNew) {
-											flag = true
-											triggerTimeNew = triggerTime
-											uidTrigger = tr.Uid
-										}
-										continue
-									}
-									continue outer
-								}
-							}
-						} else if tr.isNotAbs() {
-							for {
-								d = r.After(d, false)
-								if d.IsZero() {
-									continue outer
-								}
-								if !ev.IsRruleDate(&e, d) {
-									continue
-								}
-								triggerTime = tr.parseTriggerTime(d, e.Tzid)
-								if triggerTime.After(dateTimeStartSync) {
-									if triggerTime.Before(triggerTimeNew) {
-										flag = true
-										triggerTimeNew = triggerTime
-										uidTrigger = tr.Uid
-									}
-									continue outer
-								}
-							}
-						}
-					}
-					if flag {
-						t := task{DateTime: triggerTimeNew, Uid: e.Uid, UidTrigger: uidTrigger}
-					outer1:
-						for {
-							for i := range ts {
-								if t.Uid != ts[i].Uid {
-									continue
-								} else {
-									if t.DateTime.Before(ts[i].DateTime) {
-										ts[i] = t
-										break outer1
-									} else {
-										break outer1
-									}
-								}
-							}
-							ts = append(ts, t)
-							break outer1
-						}
-					}
-				} else {
-					if e.Dtstart != "" {
-						triggerTimeNew := toTime("99991231T000000", e.Tzid)
-						var flag bool
-						var uidTrigger string
-						for _, tr := range *e.Triggers {
-							triggerTime := tr.parseTriggerTime(dtstartdatetime, e.Tzid)
-							if triggerTime.After(dateTimeStartSync) {
-								if triggerTime.Before(triggerTimeNew) {
-									flag = true
-									triggerTimeNew = triggerTime
-									uidTrigger = tr.Uid
-								}
-							}
-						}
-						if flag {
-							t := task{DateTime: triggerTimeNew, Uid: e.Uid, UidTrigger: uidTrigger}
-						outer2:
-							for {
-								for i := range ts {
-									if t.Uid != ts[i].Uid {
-										continue
-									} else {
-										if t.DateTime.Before(ts[i].DateTime) {
-											ts[i] = t
-											break outer2
-										} else {
-											break outer2
-										}
-									}
-								}
-								ts = append(ts, t)
-								break outer2
-							}
-						}
-					}
+		for i := range *ev.Events {
+			e := &(*ev.Events)[i]
+			if !e.isForSMS() {
+				continue
+			}
+			et, err := ev.eventTasks(s, e, dateTimeStartSync, horizon)
+			if err != nil {
+				s.cfg.Logger.Printf("Событие %v календаря %v пропущено: %v", e.Uid, e.Calendar, err)
+				continue
+			}
+			ts = append(ts, et...)
+		}
+	}
+	return &tasks{Task: &ts}, nil
+}
+
+// Функция рассчитывает напоминания события e, следующие после dateTimeStartSync, до horizon
+func (ev *events) eventTasks(s *Syncer, e *event, dateTimeStartSync, horizon time.Time) ([]task, error) {
+	var ts []task
+	dtstartdatetime, length, err := e.bounds(s)
+	if err != nil {
+		return nil, err
+	}
+	if dtstartdatetime.IsZero() {
+		return nil, nil
+	}
+	var r *rrule.RRule
+	if e.Rrule != "" {
+		if r, err = rrule.StrToRRule(e.Rrule); err != nil {
+			return nil, fmt.Errorf("%w: RRULE события %v: %v", ErrInvalidTime, e.Uid, err)
+		}
+		r.DTStart(dtstartdatetime)
+	}
+	for _, tr := range *e.Triggers {
+		if !s.isActionAllowed(tr.Action) {
+			continue
+		}
+		repeatDelta, err := tr.repeatDelta()
+		if err != nil {
+			return nil, err
+		}
+		// напоминание и его повторы (REPEAT/DURATION), наступающие после dateTimeStartSync
+		add := func(triggerTime, occurrence time.Time) bool {
+			var added bool
+			for k := 0; k <= tr.Repeat; k++ {
+				if t := triggerTime.Add(time.Duration(k) * repeatDelta); t.After(dateTimeStartSync) {
+					ts = append(ts, task{Calendar: e.Calendar, DateTime: t, Occurrence: occurrence, Uid: e.Uid, UidTrigger: tr.Uid, Repeat: k})
+					added = true
 				}
 			}
+			return added
+		}
+		triggerTime, err := e.triggerTime(s, &tr, dtstartdatetime, length)
+		if err != nil {
+			return nil, err
+		}
+		// неповторяющееся событие и абсолютное время напоминания: напоминание одно
+		if r == nil || !tr.isNotAbs() {
+			add(triggerTime, dtstartdatetime)
+			continue
+		}
+		// первое повторение, напоминание (или последний повтор напоминания) которого наступает после dateTimeStartSync
+		d := dateTimeStartSync.Add(-triggerTime.Sub(dtstartdatetime) - time.Duration(tr.Repeat)*repeatDelta)
+		if e.isAllDay() {
+			// перенос на AllDayTime и из тихих часов сдвигает напоминание в пределах суток
+			d = d.Add(-48 * time.Hour)
+		}
+		var found bool
+		for {
+			if d = r.After(d, false); d.IsZero() {
+				break
+			}
+			if isRruleDate, err := ev.IsRruleDate(s, e, d); err != nil {
+				return nil, err
+			} else if !isRruleDate {
+				continue
+			}
+			if triggerTime, err = e.triggerTime(s, &tr, d, length); err != nil {
+				return nil, err
+			}
+			if found && triggerTime.After(horizon) {
+				break
+			}
+			if add(triggerTime, d) {
+				found = true
+			}
 		}
 	}
-	return &tasks{Task: &ts}
+	return ts, nil
 }
 
 // Функция выполняет запись Mesages в хранилище
+// Напоминания событий из ts заменяют все ранее запланированные напоминания этих событий
 func (ts *tasks) writeDB(driver *driver) error {
+	keys := make(map[string]bool)
 	for _, m := range *ts.Task {
-		m.DeleteDB(driver)
-		if err := driver.Driver.Insert(m); err != nil {
-			return err
+		keys[eventKey(m.Calendar, m.Uid)] = true
+	}
+	return driver.replaceTasksDB(keys, *ts.Task)
+}
+
+// Функция заменяет все напоминания событий с ключами keys (см. eventKey) напоминаниями ts
+// Напоминания читаются из хранилища и записываются в него один раз, сколько бы событий ни изменилось
+func (driver *driver) replaceTasksDB(keys map[string]bool, ts []task) error {
+	result, err := driver.getTasksDB()
+	if err != nil {
+		return err
+	}
+	kept := result[:0]
+	for _, m := range result {
+		if !keys[eventKey(m.Calendar, m.Uid)] {
+			kept = append(kept, m)
 		}
 	}
-	return nil
+	if len(kept) == len(result) && len(ts) == 0 {
+		return nil
+	}
+	for _, m := range ts {
+		m.Id = taskKey(m.Calendar, m.Uid, m.UidTrigger, m.Occurrence, m.Repeat)
+		kept = append(kept, m)
+	}
+	return driver.writeAllDB(kept)
 }
 
-// Функция получает из БД event по его индентификатору
-func (driver *driver) getEventsByUidDB(uid string) *events {
+// Функция удаляет из хранилища все напоминания событий с ключами keys
+func (driver *driver) deleteTasksDB(keys map[string]bool) error {
+	return driver.replaceTasksDB(keys, nil)
+}
+
+// Функция получает из БД все сообщения
+func (driver *driver) getTasksDB() ([]task, error) {
+	var result []task
+	if err := driver.Driver.Open(task{}).AsEntity(&result); err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	return result, nil
+}
+
+// Функция получает из БД все события
+func (driver *driver) getEventsDB() ([]event, error) {
 	var result []event
-	driver.Driver.Open(event{}).Where("uid", "=", uid).Get().AsEntity(&result)
-	return &events{Events: &result}
+	if err := driver.Driver.Open(event{}).AsEntity(&result); err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	return result, nil
 }
 
-func (ev event) DeleteDB(driver *driver) {
-	driver.Driver.Delete(ev)
+// Функция получает из БД event по календарю и индентификатору
+func (driver *driver) getEventsByUidDB(calendarpath, uid string) *events {
+	var result []event
+	driver.Driver.Open(event{}).Where("id", "=", eventKey(calendarpath, uid)).Get().AsEntity(&result)
+	return &events{Events: &result}
 }
 
-// Функция выполняет удаление событий из хранилища
-func (ev *events) DeleteDB(driver *driver) {
-	for _, e := range *ev.Events {
-		e.DeleteDB(driver)
+// Функция заменяет все записи событий с ключами keys (см. eventKey) событиями es
+// События читаются из хранилища и записываются в него один раз
+func (driver *driver) replaceEventsDB(keys map[string]bool, es []event) error {
+	result, err := driver.getEventsDB()
+	if err != nil {
+		return err
+	}
+	kept := result[:0]
+	for _, e := range result {
+		if !keys[e.Id] {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(result) && len(es) == 0 {
+		return nil
 	}
+	return driver.writeAllDB(append(kept, es...))
 }
 
 // Функция выполняет запись events в хранилище
+// События заменяют все ранее записанные события с теми же ключами, в хранилище попадают только события с напоминаниями
 func (ev *events) writeDB(driver *driver) error {
-	ev.DeleteDB(driver)
+	keys := make(map[string]bool)
+	var es []event
 	for _, e := range *ev.Events {
+		e.Id = eventKey(e.Calendar, e.Uid)
+		keys[e.Id] = true
 		if e.isForSMS() {
-			if err := driver.Driver.Insert(e); err != nil {
-				return err
-			}
+			es = append(es, e)
 		}
 	}
-	return nil
+	return driver.replaceEventsDB(keys, es)
 }
 
 func (c event) ID() (jsonField string, value interface{}) {
 	{
-		value = c.Uid
-		jsonField = "uid"
+		value = eventKey(c.Calendar, c.Uid)
+		jsonField = "id"
 		return
 	}
 }
 
 func (c task) ID() (jsonField string, value interface{}) {
 	{
-		value = c.Uid
-		jsonField = "uid"
+		value = taskKey(c.Calendar, c.Uid, c.UidTrigger, c.Occurrence, c.Repeat)
+		jsonField = "id"
 		return
 	}
 }
 
-// Функция выполняет удаление сообщения из Message
-func (m *task) DeleteDB(driver *driver) {
-	driver.Driver.Delete(m)
+func (tr *trigger) isNotAbs() bool {
+	return strings.HasPrefix(tr.Trigger, "P") || strings.HasPrefix(tr.Trigger, "-P") || strings.HasPrefix(tr.Trigger, "+P")
 }
 
-func (tr *trigger) isNotAbs() bool {
-	return tr.Trigger[0:1] == "P" || tr.Trigger[1:2] == "P"
+// Функция возвращает интервал между повторами напоминания
+func (tr *trigger) repeatDelta() (time.Duration, error) {
+	if tr.Repeat == 0 {
+		return 0, nil
+	}
+	if tr.Duration == "" {
+		return 0, fmt.Errorf("%w: REPEAT без DURATION", ErrInvalidTrigger)
+	}
+	delta, err := iso8601.ParseDuration(strings.TrimPrefix(tr.Duration, "+"))
+	if err != nil || delta <= 0 {
+		return 0, fmt.Errorf("%w: DURATION '%v'", ErrInvalidTrigger, tr.Duration)
+	}
+	return delta, nil
+}
+
+// Функция проверяет, отправляются ли сообщения по напоминаниям с действием action
+func (s *Syncer) isActionAllowed(action string) bool {
+	if len(s.cfg.Actions) == 0 {
+		return true
+	}
+	for _, a := range s.cfg.Actions {
+		if strings.EqualFold(a, action) {
+			return true
+		}
+	}
+	return false
 }
 
 func (tr *trigger) isNegative() bool {
-	return tr.Trigger[0:1] == "-"
+	return strings.HasPrefix(tr.Trigger, "-")
+}
+
+// Функция возвращает смещение относительного напоминания со знаком
+func (tr *trigger) delta() (time.Duration, error) {
+	delta, err := iso8601.ParseDuration(strings.TrimLeft(tr.Trigger, "+-"))
+	if err != nil {
+		return 0, fmt.Errorf("%w: '%v': %v", ErrInvalidTrigger, tr.Trigger, err)
+	}
+	if tr.isNegative() {
+		delta = -delta
+	}
+	return delta, nil
 }
 
-func (tr *trigger) parseTriggerTime(dtstartdatetime time.Time, loc string) time.Time {
-	/*Функция возвращает время напоминания по входному значению dtstart и дельты trigger формата:
+func (tr *trigger) parseTriggerTime(s *Syncer, dtstartdatetime time.Time, length time.Duration) (time.Time, error) {
+	/*Функция возвращает время напоминания по входному значению dtstart и дельты trigger формата
+	  (при RELATED=END дельта отсчитывается от окончания события dtstart+length):
 	  trigger := "PT0S" // время события
 	  trigger := "-PT2H" // за 2 часа до события
 	  trigger := "-PT5M" // за 5 минут до события
@@ -670,54 +916,152 @@ func (tr *trigger) parseTriggerTime(dtstartdatetime time.Time, loc string) time.
 	  trigger := "20230312T143500Z"
 	*/
 
-	trigger := tr.Trigger
 	if tr.isNotAbs() {
-		var sign int8 = 1
-		if tr.isNegative() {
-			sign = -1
-			trigger = trigger[1:]
-		}
-		delta, err := iso8601.ParseDuration(trigger)
+		delta, err := tr.delta()
 		if err != nil {
-			panic(err)
+			return time.Time{}, err
 		}
-		return dtstartdatetime.Add(time.Duration(sign) * delta)
+		anchor := dtstartdatetime
+		if tr.Related == "END" {
+			anchor = anchor.Add(length)
+		}
+		return anchor.Add(delta), nil
 	} else {
-		return toTime(trigger, loc)
+		// абсолютное время напоминания всегда задается в UTC
+		t, err := s.toTime(tr.Trigger, "")
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: '%v': %v", ErrInvalidTrigger, tr.Trigger, err)
+		}
+		return t, nil
 	}
 }
 
 func (ev event) isForSMS() bool {
-	return ev.Reccurence != "" || (ev.TextSMS != "" && len(*ev.PhonesSMS) != 0 && ev.Dtstart != "" && ev.Status != "COMPLETED")
+	return ev.Reccurence != "" || (ev.TextSMS != "" && ev.hasRecipients() && (ev.Dtstart != "" || ev.Due != "") && ev.Status != "COMPLETED")
+}
+
+// Функция возвращает начало события и его длительность, от которых отсчитываются напоминания
+// Длительность задается DTEND, DUE (у задачи) или DURATION, у события на весь день без них - один день.
+// У задачи без DTSTART началом считается DUE. Если нет ни DTSTART, ни DUE, возвращается нулевое время.
+func (ev *event) bounds(s *Syncer) (time.Time, time.Duration, error) {
+	if ev.Dtstart == "" {
+		if ev.Due == "" {
+			return time.Time{}, 0, nil
+		}
+		due, err := ev.toTime(s, ev.Due, ev.DueTzid)
+		return due, 0, err
+	}
+	start, err := ev.toTime(s, ev.Dtstart, ev.Tzid)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	var end, endTzid string
+	switch {
+	case ev.Dtend != "":
+		end, endTzid = ev.Dtend, ev.DtendTzid
+	case ev.Due != "":
+		end, endTzid = ev.Due, ev.DueTzid
+	case ev.Duration != "":
+		length, err := iso8601.ParseDuration(strings.TrimPrefix(ev.Duration, "+"))
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("%w: DURATION '%v': %v", ErrInvalidTime, ev.Duration, err)
+		}
+		return start, length, nil
+	case len(ev.Dtstart) == len(dateFormat):
+		return start, 24 * time.Hour, nil
+	default:
+		return start, 0, nil
+	}
+	t, err := ev.toTime(s, end, endTzid)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return start, t.Sub(start), nil
+}
+
+// Функция проверяет, есть ли у события получатели: в описании или в ATTENDEE напоминаний
+func (ev event) hasRecipients() bool {
+	if ev.PhonesSMS != nil && len(*ev.PhonesSMS) != 0 {
+		return true
+	}
+	if ev.Triggers != nil {
+		for _, tr := range *ev.Triggers {
+			if len(tr.Phones) != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Функция возвращает получателей напоминания: номера из описания события и из ATTENDEE напоминания без повторов
+func (ev event) recipients(tr *trigger) []phone {
+	var result []phone
+	seen := make(map[string]bool)
+	var phs []phone
+	if ev.PhonesSMS != nil {
+		phs = append(phs, *ev.PhonesSMS...)
+	}
+	if tr != nil {
+		phs = append(phs, tr.Phones...)
+	}
+	for _, p := range phs {
+		if !seen[p.Phone] {
+			seen[p.Phone] = true
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// Функция возвращает напоминание события по UID напоминания
+func (ev event) trigger(uid string) (*trigger, bool) {
+	if ev.Triggers != nil {
+		for i := range *ev.Triggers {
+			if (*ev.Triggers)[i].Uid == uid {
+				return &(*ev.Triggers)[i], true
+			}
+		}
+	}
+	return nil, false
 }
 
 // Функция проверяет, были ли переносы или удаление конкретных дат повторяющихся событий
-func (ev *events) IsRruleDate(x *event, dtstartdatetime time.Time) bool {
+func (ev *events) IsRruleDate(s *Syncer, x *event, dtstartdatetime time.Time) (bool, error) {
 
 	if x.Rrule == "" {
-		panic("Нельзя проверять дату Rrule у неповторяющихся событий")
+		return false, fmt.Errorf("Нельзя проверять дату Rrule у неповторяющихся событий")
 	}
 	for _, e := range *ev.Events {
-		if e.Uid == x.Uid && e.Rrule == "" && e.Reccurence != "" {
-			if dtstartdatetime.Equal(toTime(e.Reccurence, e.Tzid)) {
-				return false
+		if e.Uid == x.Uid && e.Calendar == x.Calendar && e.Rrule == "" && e.Reccurence != "" {
+			t, err := e.toTime(s, e.Reccurence, e.ReccurenceTzid)
+			if err != nil {
+				return false, err
+			}
+			if dtstartdatetime.Equal(t) {
+				return false, nil
 			}
 		}
 	}
 	if x.Exdates != nil {
 		for _, d := range *x.Exdates {
-			if (toTime(d.Exdate, x.Tzid)).Equal(dtstartdatetime) {
-				return false
+			t, err := x.toTime(s, d.Exdate, d.Tzid)
+			if err != nil {
+				return false, err
+			}
+			if t.Equal(dtstartdatetime) {
+				return false, nil
 			}
 		}
 	}
-	return true
+	return true, nil
 }
 
 // Функция выполняет получение сообщений из базы данных, которые идут раньше времени t
 func (driver *driver) getMessagesBefore(t time.Time) (*tasks, error) {
-	var result, ts []task
-	if err := driver.Driver.Open(task{}).AsEntity(&result); err != nil {
+	var ts []task
+	result, err := driver.getTasksDB()
+	if err != nil {
 		return nil, err
 	}
 	for _, m := range result {
@@ -731,119 +1075,81 @@ func (driver *driver) getMessagesBefore(t time.Time) (*tasks, error) {
 	return &tasks{Task: &ts}, nil
 }
 
-// Функция выполняет рассылку сообщений
-func (ts *tasks) sendMessages(driver *driver) {
+// Функция возвращает время ближайшего сообщения в хранилище
+func (driver *driver) getNextTaskTime() (time.Time, bool, error) {
+	result, err := driver.getTasksDB()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	var next time.Time
+	for _, m := range result {
+		if next.IsZero() || m.DateTime.Before(next) {
+			next = m.DateTime
+		}
+	}
+	return next, !next.IsZero(), nil
+}
+
+// Функция возвращает сообщения для рассылки по сообщениям из хранилища: по одному на каждого получателя напоминания
+func (ts *tasks) getMessages(driver *driver) []message {
 	var ms []message
 outer:
 	for _, t := range *ts.Task {
-		ev := driver.getEventsByUidDB(t.Uid)
+		ev := driver.getEventsByUidDB(t.Calendar, t.Uid)
 		for _, e := range *ev.Events {
-			for _, tr := range *e.Triggers {
-				if t.UidTrigger == tr.Uid {
-					for _, p := range *e.PhonesSMS {
-						ms = append(ms, message{Phone: p.Phone, Text: e.TextSMS})
-					}
-					continue outer
+			if tr, ok := e.trigger(t.UidTrigger); ok {
+				for _, p := range e.recipients(tr) {
+					ms = append(ms, message{Phone: p.Phone, Text: e.TextSMS, Calendar: t.Calendar, Uid: t.Uid, UidTrigger: t.UidTrigger, Repeat: t.Repeat, DateTime: t.DateTime, Occurrence: t.Occurrence})
 				}
+				continue outer
 			}
 		}
 	}
-	for _, m := range ms {
-		//fmt.Println("Отправка сообщения=", m)
-		http.Get("http://10.39.1.12/default/en_US/send.html?u=admin&p=admin&l=2&n=" + m.Phone + "&m=" + url.QueryEscape(m.Text))
-		if len(ms) > 1 {
-			time.Sleep(10 * time.Second)
-		}
-	}
-}
-
-func genNewMessages(driver *driver, ts *tasks, tm time.Time) {
-	for _, m := range *ts.Task {
-		m.DeleteDB(driver)
-		ev := driver.getEventsByUidDB(m.Uid)
-		mNew := ev.calcMessages(tm)
-		if *mNew.Task == nil {
-			ev.DeleteDB(driver)
-		}
-		mNew.writeDB(driver)
-	}
+	return ms
 }
 
-// Функция получает на вход имя, пароль, адрес, имя календаря, локализацию, первый токен (для архивной загрузки),
-// минимальное время (для того, чтобы из-за сбоя времени и отсутствия файла базы данных не сыпались старые СМС)
-// и запускает процесс синхронизации
-func Sync(username, password, uri, calendarname, location, storagename, firsttoken string, mintime time.Time) {
-	dmintime = mintime
-	dfirsttoken = firsttoken
-	dlocation = location
-
-	currenttime, err := getCurrentTime()
-	if err != nil {
-		panic(err)
-	}
-	driver, err := initDriver(storagename)
-	if err != nil {
-		panic(err)
-	}
-	db, err := driver.getPropsDB()
-	if err != nil {
-		panic(err)
-	}
-	client, err := newClient(username, password, uri)
-	if err != nil {
-		panic(err)
-	}
-	calendarpath, err := client.getCalendarPath(calendarname)
-	if err != nil {
-		panic(err)
-	}
-	itempaths, err := client.getCalendarChanges(calendarpath, db.Token)
-	if err != nil {
-		panic(err)
-	}
-	token, err := client.getNewCalendarToken(calendarpath)
+// Функция рассчитывает следующие напоминания событий после наступивших напоминаний ts
+// Расчет ведется от времени наступившего напоминания, а не от текущего времени, чтобы напоминания,
+// пропущенные за время простоя, не терялись молча, а обрабатывались по правилу MissedPolicy.
+// События без следующих напоминаний удаляются. Хранилище читается и записывается один раз на все события.
+func genNewMessages(s *Syncer, driver *driver, ts *tasks) error {
+	result, err := driver.getEventsDB()
 	if err != nil {
-		panic(err)
-	}
-	if err := itempaths.deleteNotActualPathsDB(driver); err != nil {
-		panic(err)
+		return err
 	}
-	ev, err := itempaths.getEvents()
-	if err != nil {
-		panic(err)
+	byKey := make(map[string][]event)
+	for _, e := range result {
+		byKey[e.Id] = append(byKey[e.Id], e)
 	}
-	ms := ev.calcMessages(db.DateTime)
-	ms.writeDB(driver)
-
-	var evActualChanges []event
-outer:
-	for _, e := range *ev.Events {
-		for _, m := range *ms.Task {
-			if e.Uid == m.Uid {
-				evActualChanges = append(evActualChanges, e)
-				continue outer
-			}
+	// напоминания события рассчитываются от последнего наступившего напоминания
+	var keys []string
+	from := make(map[string]time.Time)
+	for _, m := range *ts.Task {
+		key := eventKey(m.Calendar, m.Uid)
+		if t, ok := from[key]; !ok {
+			keys = append(keys, key)
+		} else if !m.DateTime.After(t) {
+			continue
 		}
-		e.DeleteDB(driver)
-		m := task{Uid: e.Uid}
-		m.DeleteDB(driver)
+		from[key] = m.DateTime
 	}
-	ev = nil
-
-	EventsActualChanges := events{Events: &evActualChanges}
-	// записываем в БД только актуальные Event
-	if err := EventsActualChanges.writeDB(driver); err != nil {
-		panic(err)
+	replaced := make(map[string]bool, len(keys))
+	finished := make(map[string]bool)
+	var newTasks []task
+	for _, key := range keys {
+		es := byKey[key]
+		mNew, err := (&events{Events: &es}).calcMessages(s, from[key])
+		if err != nil {
+			return err
+		}
+		replaced[key] = true
+		if len(*mNew.Task) == 0 {
+			finished[key] = true
+		}
+		newTasks = append(newTasks, *mNew.Task...)
 	}
-
-	msForSend, err := driver.getMessagesBefore(currenttime)
-	if err != nil {
-		panic(err)
+	if err := driver.replaceTasksDB(replaced, newTasks); err != nil {
+		return err
 	}
-	// отправляем сообщение
-	msForSend.sendMessages(driver)
-
-	//генерируем новые даты сообщений для будущих отправок
-	genNewMessages(driver, msForSend, currenttime)
-	driver.writePropsDB(currenttime, token)
+	return driver.replaceEventsDB(finished, nil)
 }
@@ -0,0 +1,144 @@
+package caldavsms
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Функция возвращает событие с описанием для SMS и напоминаниями triggers
+func testEvent(t *testing.T, s *Syncer, uid, dtstart string, triggers ...trigger) event {
+	t.Helper()
+	e := event{Calendar: "cal", Uid: uid, Dtstart: dtstart, Description: "SMS: 89001234567: Напоминание", Exdates: &[]exdate{}, Triggers: &triggers}
+	if err := e.calc(s); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// Функция возвращает напоминания в виде "uid/trigger время повтор", отсортированные по времени и событию
+func formatTasks(ts []task) []string {
+	sort.Slice(ts, func(i, j int) bool {
+		if !ts[i].DateTime.Equal(ts[j].DateTime) {
+			return ts[i].DateTime.Before(ts[j].DateTime)
+		}
+		return ts[i].Uid+ts[i].UidTrigger < ts[j].Uid+ts[j].UidTrigger
+	})
+	var result []string
+	for _, m := range ts {
+		result = append(result, fmt.Sprintf("%v/%v %v %v", m.Uid, m.UidTrigger, m.DateTime.UTC().Format("01-02 15:04"), m.Repeat))
+	}
+	return result
+}
+
+func TestCalcMessages(t *testing.T) {
+	start := time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		horizon time.Duration
+		start   time.Time
+		events  func(t *testing.T, s *Syncer) []event
+		want    []string
+	}{
+		{name: "несколько VALARM", events: func(t *testing.T, s *Syncer) []event {
+			return []event{testEvent(t, s, "e", "20250110T100000Z", trigger{Uid: "a", Trigger: "-PT15M"}, trigger{Uid: "b", Trigger: "-P1D"})}
+		}, want: []string{"e/b 01-09 10:00 0", "e/a 01-10 09:45 0"}},
+		{name: "RRULE с EXDATE и измененным повторением", events: func(t *testing.T, s *Syncer) []event {
+			master := testEvent(t, s, "e", "20250106T100000Z", trigger{Uid: "a", Trigger: "-PT10M"})
+			master.Rrule = "FREQ=DAILY;COUNT=5"
+			master.Exdates = &[]exdate{{Exdate: "20250108T100000Z"}}
+			// повторение 9 января перенесено на 15:00
+			override := testEvent(t, s, "e", "20250109T150000Z", trigger{Uid: "a", Trigger: "-PT10M"})
+			override.Reccurence = "20250109T100000Z"
+			return []event{master, override}
+		}, want: []string{"e/a 01-06 09:50 0", "e/a 01-07 09:50 0", "e/a 01-09 14:50 0", "e/a 01-10 09:50 0"}},
+		{name: "REPEAT и DURATION", events: func(t *testing.T, s *Syncer) []event {
+			return []event{testEvent(t, s, "e", "20250107T120000Z", trigger{Uid: "a", Trigger: "-PT30M", Repeat: 2, Duration: "PT10M"})}
+		}, want: []string{"e/a 01-07 11:30 0", "e/a 01-07 11:40 1", "e/a 01-07 11:50 2"}},
+		{name: "REPEAT после начала синхронизации", start: time.Date(2025, 1, 7, 11, 35, 0, 0, time.UTC), events: func(t *testing.T, s *Syncer) []event {
+			return []event{testEvent(t, s, "e", "20250107T120000Z", trigger{Uid: "a", Trigger: "-PT30M", Repeat: 2, Duration: "PT10M"})}
+		}, want: []string{"e/a 01-07 11:40 1", "e/a 01-07 11:50 2"}},
+		{name: "период планирования", horizon: 48 * time.Hour, events: func(t *testing.T, s *Syncer) []event {
+			e := testEvent(t, s, "e", "20250101T100000Z", trigger{Uid: "a", Trigger: "-PT10M"})
+			e.Rrule = "FREQ=DAILY"
+			return []event{e}
+		}, want: []string{"e/a 01-06 09:50 0", "e/a 01-07 09:50 0"}},
+		{name: "ближайшее напоминание за периодом планирования", horizon: 24 * time.Hour, events: func(t *testing.T, s *Syncer) []event {
+			e := testEvent(t, s, "e", "20250101T100000Z", trigger{Uid: "a", Trigger: "-PT10M"})
+			e.Rrule = "FREQ=MONTHLY"
+			return []event{e}
+		}, want: []string{"e/a 02-01 09:50 0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSyncer(t, func(cfg *Config) {
+				if tt.horizon > 0 {
+					cfg.Horizon = tt.horizon
+				}
+			})
+			es := tt.events(t, s)
+			from := start
+			if !tt.start.IsZero() {
+				from = tt.start
+			}
+			ts, err := (&events{Events: &es}).calcMessages(s, from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatTasks(*ts.Task); strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Errorf("напоминания %q, ожидаются %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Наступившие напоминания ставятся в очередь, вместо них рассчитываются следующие,
+// события без следующих напоминаний удаляются из хранилища
+func TestEnqueueDueAdvancesTasks(t *testing.T) {
+	s := newTestSyncer(t, nil)
+	daily := testEvent(t, s, "daily", "20250106T100000Z", trigger{Uid: "a", Trigger: "PT0S"})
+	daily.Rrule = "FREQ=DAILY;COUNT=2"
+	once := testEvent(t, s, "once", "20250106T100000Z", trigger{Uid: "a", Trigger: "PT0S"}, trigger{Uid: "b", Trigger: "-PT1H"})
+	ev := &events{Events: &[]event{daily, once}}
+	ts, err := ev.calcMessages(s, time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ev.writeDB(s.driver); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.writeDB(s.driver); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		at         time.Time
+		wantTasks  []string
+		wantEvents int
+		wantQueued int
+	}{
+		{time.Date(2025, 1, 6, 9, 30, 0, 0, time.UTC), []string{"daily/a 01-06 10:00 0", "once/a 01-06 10:00 0", "daily/a 01-07 10:00 0"}, 2, 1},
+		{time.Date(2025, 1, 6, 12, 0, 0, 0, time.UTC), []string{"daily/a 01-07 10:00 0"}, 1, 3},
+		{time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC), nil, 0, 4},
+	}
+	for i, step := range steps {
+		if err := s.enqueueDue(step.at); err != nil {
+			t.Fatal(err)
+		}
+		result, err := s.driver.getTasksDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatTasks(result); strings.Join(got, "; ") != strings.Join(step.wantTasks, "; ") {
+			t.Errorf("шаг %v: напоминания %q, ожидаются %q", i+1, got, step.wantTasks)
+		}
+		if es, _ := s.driver.getEventsDB(); len(es) != step.wantEvents {
+			t.Errorf("шаг %v: событий %v, ожидается %v", i+1, len(es), step.wantEvents)
+		}
+		if os, _ := s.driver.getOutboxDB(); len(os) != step.wantQueued {
+			t.Errorf("шаг %v: в очереди %v сообщений, ожидается %v", i+1, len(os), step.wantQueued)
+		}
+	}
+}
@@ -0,0 +1,907 @@
+package main
+
+import (
+	"caldavsms"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Префикс переменных окружения, например CALDAVSMS_USERNAME
+const envPrefix = "CALDAVSMS_"
+
+// Параметры шлюза GoIP
+type goipConfig struct {
+	Host     string `json:"host"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Line     int    `json:"line"`
+	Template string `json:"template"`
+	// Линии (SIM-порты), по которым распределяются сообщения; если не заданы, используется линия line
+	Lines []goipLineConfig `json:"lines"`
+}
+
+// Параметры линии шлюза GoIP, незаданные адрес и учетные данные берутся из параметров шлюза
+type goipLineConfig struct {
+	Line     int    `json:"line"`
+	Host     string `json:"host"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// Количество одновременных отправок через линию и ограничение скорости линии вида "10/m"
+	Concurrency int    `json:"concurrency"`
+	Rate        string `json:"rate"`
+	Burst       int    `json:"burst"`
+}
+
+// Параметры SMPP-сервера оператора; если задан адрес, сообщения отправляются через SMPP вместо GoIP
+type smppConfig struct {
+	Addr       string `json:"addr"`
+	SystemID   string `json:"systemid"`
+	Password   string `json:"password"`
+	SystemType string `json:"systemtype"`
+	// Адрес отправителя: номер телефона или буквенное имя
+	Source string `json:"source"`
+	// Период запросов enquire_link
+	EnquireLink string `json:"enquirelink"`
+	// Запрашивать отчеты о доставке и записывать их в очередь сообщений
+	Receipts bool `json:"receipts"`
+}
+
+// Параметры HTTP-шлюза (REST API провайдера); если задан адрес, сообщения отправляются HTTP-запросом вместо GoIP
+// Адрес и тело - шаблоны с полями .Phone, .Text, .Uid, .Calendar, .DateTime, например {"to": {{json .Phone}}, "text": {{json .Text}}}
+type webhookConfig struct {
+	URL      string            `json:"url"`
+	Method   string            `json:"method"`
+	Headers  map[string]string `json:"headers"`
+	Body     string            `json:"body"`
+	Bearer   string            `json:"bearer"`
+	User     string            `json:"user"`
+	Password string            `json:"password"`
+	// Признаки успешной отправки: статусы ответа, путь к полю JSON-ответа и его значение
+	SuccessStatus []int  `json:"successstatus"`
+	SuccessPath   string `json:"successpath"`
+	SuccessValue  string `json:"successvalue"`
+	// Путь к идентификатору сообщения в JSON-ответе, например "messages.0.id"
+	MessageIDPath string `json:"messageidpath"`
+}
+
+// Параметры GSM-модема на последовательном порту; если задан порт, сообщения отправляются через модем вместо GoIP
+type modemConfig struct {
+	Device string `json:"device"`
+	Baud   int    `json:"baud"`
+	// Отправлять короткие латинские сообщения в текстовом режиме (AT+CMGF=1) вместо PDU
+	TextMode bool `json:"textmode"`
+}
+
+// Параметры бота Telegram для получателей tg:<chat_id>
+type telegramConfig struct {
+	Token  string `json:"token"`
+	APIURL string `json:"apiurl"`
+}
+
+// Параметры SMTP-сервера для получателей mailto:<адрес>
+type emailConfig struct {
+	Addr     string `json:"addr"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	Subject  string `json:"subject"`
+}
+
+// Параметры учетной записи Matrix для получателей @user:server
+type matrixConfig struct {
+	Homeserver string `json:"homeserver"`
+	Token      string `json:"token"`
+}
+
+// Параметры учетной записи CalDAV, незаданные значения берутся из общих параметров
+type accountConfig struct {
+	Username  string         `json:"username"`
+	Password  string         `json:"password"`
+	Calendars []string       `json:"calendars"`
+	Location  string         `json:"location"`
+	GoIP      *goipConfig    `json:"goip"`
+	SMPP      *smppConfig    `json:"smpp"`
+	Webhook   *webhookConfig `json:"webhook"`
+	Modem     *modemConfig   `json:"modem"`
+}
+
+// Параметры командной строки, файла конфигурации и переменных окружения
+type config struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	URI        string   `json:"uri"`
+	Calendars  []string `json:"calendars"`
+	Location   string   `json:"location"`
+	Storage    string   `json:"storage"`
+	FirstToken string   `json:"firsttoken"`
+	MinTime    string   `json:"mintime"`
+	Interval   string   `json:"interval"`
+	// Пауза перед первой повторной отправкой и срок повторных отправок
+	RetryBackoff  string `json:"retrybackoff"`
+	RetryDeadline string `json:"retrydeadline"`
+	// Правило обработки пропущенных напоминаний: all, grace, drop
+	MissedPolicy    string `json:"missedpolicy"`
+	MissedTolerance string `json:"missedtolerance"`
+	MissedGrace     string `json:"missedgrace"`
+	// Период планирования напоминаний повторяющихся событий
+	Horizon string `json:"horizon"`
+	// Срок хранения обработанных сообщений в журнале отправки
+	OutboxRetention string `json:"outboxretention"`
+	// Значения ACTION напоминаний, по которым отправляются сообщения; пустой список - все
+	Actions []string `json:"actions"`
+	// Время напоминаний событий на весь день (15:04), тихие часы (22:00-08:00) и правило переноса из них: none, after, before
+	AllDayTime  string `json:"alldaytime"`
+	QuietHours  string `json:"quiethours"`
+	QuietPolicy string `json:"quietpolicy"`
+	// Окна доставки вида "mon-fri 09:00-20:00; sat 10:00-18:00", праздничные дни и правило: defer, drop
+	Windows      string   `json:"windows"`
+	Holidays     []string `json:"holidays"`
+	WindowPolicy string   `json:"windowpolicy"`
+	// Максимальное количество частей SMS и правило для более длинных сообщений: truncate, drop
+	MaxSegments   int    `json:"maxsegments"`
+	SegmentPolicy string `json:"segmentpolicy"`
+	// Ограничение скорости отправки через каждый шлюз и на один номер вида "30/m", до burst сообщений подряд
+	Rate           string        `json:"rate"`
+	Burst          int           `json:"burst"`
+	RecipientRate  string        `json:"recipientrate"`
+	RecipientBurst int           `json:"recipientburst"`
+	DryRun         bool          `json:"-"`
+	GoIP           goipConfig    `json:"goip"`
+	SMPP           smppConfig    `json:"smpp"`
+	Webhook        webhookConfig `json:"webhook"`
+	Modem          modemConfig   `json:"modem"`
+	// Каналы доставки кроме SMS, общие для всех учетных записей
+	Telegram telegramConfig `json:"telegram"`
+	Email    emailConfig    `json:"email"`
+	Matrix   matrixConfig   `json:"matrix"`
+	// Учетные записи; если не заданы, используется одна учетная запись username/password
+	Accounts []accountConfig `json:"accounts"`
+}
+
+// Общий интерфейс Syncer и MultiSyncer
+type syncer interface {
+	Sync(ctx context.Context) error
+	Run(ctx context.Context, interval time.Duration) error
+	Upcoming(f caldavsms.UpcomingFilter) ([]caldavsms.Upcoming, error)
+	ApplyReceipt(r caldavsms.DeliveryReceipt) (bool, error)
+}
+
+// Параметр, который можно задать в файле, переменной окружения и флагом
+type option struct {
+	name  string
+	usage string
+	set   func(c *config, v string) error
+}
+
+func stringOption(name, usage string, field func(c *config) *string) option {
+	return option{name: name, usage: usage, set: func(c *config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func intOption(name, usage string, field func(c *config) *int) option {
+	return option{name: name, usage: usage, set: func(c *config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("некорректное число '%v'", v)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+var options = []option{
+	stringOption("username", "имя пользователя CalDAV", func(c *config) *string { return &c.Username }),
+	stringOption("password", "пароль пользователя CalDAV", func(c *config) *string { return &c.Password }),
+	stringOption("uri", "адрес CalDAV-сервиса", func(c *config) *string { return &c.URI }),
+	{name: "calendars", usage: "имена календарей через запятую, \"*\" - все календари", set: func(c *config, v string) error {
+		c.Calendars = splitList(v)
+		return nil
+	}},
+	stringOption("location", "локализация, например Europe/Moscow", func(c *config) *string { return &c.Location }),
+	stringOption("storage", "каталог хранилища", func(c *config) *string { return &c.Storage }),
+	stringOption("firsttoken", "первоначальный токен синхронизации", func(c *config) *string { return &c.FirstToken }),
+	stringOption("mintime", "минимальное допустимое время, 2006-01-02 или RFC 3339", func(c *config) *string { return &c.MinTime }),
+	stringOption("interval", "интервал опроса календаря в режиме демона", func(c *config) *string { return &c.Interval }),
+	stringOption("retrybackoff", "пауза перед первой повторной отправкой, удваивается с каждой попыткой", func(c *config) *string { return &c.RetryBackoff }),
+	stringOption("retrydeadline", "срок повторных отправок от запланированного времени сообщения", func(c *config) *string { return &c.RetryDeadline }),
+	stringOption("missedpolicy", "пропущенные напоминания: all - отправлять, grace - отправлять с опозданием не больше -missedgrace, drop - не отправлять", func(c *config) *string { return &c.MissedPolicy }),
+	stringOption("missedtolerance", "опоздание, после которого напоминание считается пропущенным", func(c *config) *string { return &c.MissedTolerance }),
+	stringOption("missedgrace", "допустимое опоздание для правила grace", func(c *config) *string { return &c.MissedGrace }),
+	{name: "actions", usage: "значения ACTION напоминаний через запятую, например DISPLAY,X-SMS; пусто - все напоминания", set: func(c *config, v string) error {
+		c.Actions = splitList(v)
+		return nil
+	}},
+	stringOption("alldaytime", "время суток напоминаний событий на весь день, например 09:00", func(c *config) *string { return &c.AllDayTime }),
+	stringOption("quiethours", "тихие часы для напоминаний событий на весь день, например 22:00-08:00", func(c *config) *string { return &c.QuietHours }),
+	stringOption("quietpolicy", "напоминания в тихие часы: none - не переносить, after - на окончание, before - на начало тихих часов", func(c *config) *string { return &c.QuietPolicy }),
+	stringOption("windows", "окна доставки сообщений, например \"mon-fri 09:00-20:00; sat 10:00-18:00\"; пусто - в любое время", func(c *config) *string { return &c.Windows }),
+	{name: "holidays", usage: "праздничные дни без доставки сообщений через запятую, например 2025-01-01,2025-01-07", set: func(c *config, v string) error {
+		c.Holidays = splitList(v)
+		return nil
+	}},
+	stringOption("windowpolicy", "сообщения вне окон доставки: defer - отложить до открытия окна, drop - не отправлять", func(c *config) *string { return &c.WindowPolicy }),
+	intOption("maxsegments", "максимальное количество частей SMS (160 символов GSM 7-бит или 70 символов UCS-2 в одной части)", func(c *config) *int { return &c.MaxSegments }),
+	stringOption("segmentpolicy", "SMS длиннее -maxsegments частей: truncate - обрезать, drop - не отправлять", func(c *config) *string { return &c.SegmentPolicy }),
+	stringOption("rate", "ограничение скорости отправки через шлюз, например 30/m; 0/s - без ограничения", func(c *config) *string { return &c.Rate }),
+	intOption("burst", "количество сообщений, отправляемых через шлюз подряд без ожидания", func(c *config) *int { return &c.Burst }),
+	stringOption("recipientrate", "ограничение скорости отправки на один номер, например 5/h; пусто - без ограничения", func(c *config) *string { return &c.RecipientRate }),
+	intOption("recipientburst", "количество сообщений на один номер подряд без ожидания", func(c *config) *int { return &c.RecipientBurst }),
+	stringOption("horizon", "период вперед, на который планируются напоминания повторяющихся событий", func(c *config) *string { return &c.Horizon }),
+	stringOption("outboxretention", "срок хранения отправленных и неотправленных сообщений от времени напоминания", func(c *config) *string { return &c.OutboxRetention }),
+	stringOption("goip-host", "адрес шлюза GoIP", func(c *config) *string { return &c.GoIP.Host }),
+	stringOption("goip-user", "имя пользователя шлюза GoIP", func(c *config) *string { return &c.GoIP.User }),
+	stringOption("goip-password", "пароль шлюза GoIP", func(c *config) *string { return &c.GoIP.Password }),
+	stringOption("goip-template", "шаблон запроса к шлюзу GoIP", func(c *config) *string { return &c.GoIP.Template }),
+	{name: "goip-line", usage: "номер линии шлюза GoIP", set: func(c *config, v string) error {
+		line, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("некорректный номер линии '%v'", v)
+		}
+		c.GoIP.Line = line
+		return nil
+	}},
+	{name: "goip-lines", usage: "номера линий шлюза GoIP через запятую, по которым распределяются сообщения", set: func(c *config, v string) error {
+		c.GoIP.Lines = nil
+		for _, s := range splitList(v) {
+			line, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("некорректный номер линии '%v'", s)
+			}
+			c.GoIP.Lines = append(c.GoIP.Lines, goipLineConfig{Line: line})
+		}
+		return nil
+	}},
+	stringOption("smpp-addr", "адрес SMPP-сервера host:port; если задан, сообщения отправляются через SMPP вместо GoIP", func(c *config) *string { return &c.SMPP.Addr }),
+	stringOption("smpp-systemid", "имя пользователя (system_id) SMPP", func(c *config) *string { return &c.SMPP.SystemID }),
+	stringOption("smpp-password", "пароль SMPP", func(c *config) *string { return &c.SMPP.Password }),
+	stringOption("smpp-systemtype", "тип системы (system_type) SMPP", func(c *config) *string { return &c.SMPP.SystemType }),
+	stringOption("smpp-source", "адрес отправителя SMPP: номер или буквенное имя", func(c *config) *string { return &c.SMPP.Source }),
+	stringOption("smpp-enquirelink", "период проверки SMPP-соединения (enquire_link)", func(c *config) *string { return &c.SMPP.EnquireLink }),
+	{name: "smpp-receipts", usage: "запрашивать отчеты о доставке SMPP (true/false)", set: func(c *config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("некорректное логическое значение '%v'", v)
+		}
+		c.SMPP.Receipts = b
+		return nil
+	}},
+	stringOption("webhook-url", "шаблон адреса HTTP-шлюза; если задан, сообщения отправляются HTTP-запросом", func(c *config) *string { return &c.Webhook.URL }),
+	stringOption("webhook-method", "метод запроса к HTTP-шлюзу, по умолчанию POST", func(c *config) *string { return &c.Webhook.Method }),
+	stringOption("webhook-body", "шаблон тела запроса к HTTP-шлюзу, например {\"to\": {{json .Phone}}, \"text\": {{json .Text}}}", func(c *config) *string { return &c.Webhook.Body }),
+	stringOption("webhook-bearer", "Bearer-токен HTTP-шлюза", func(c *config) *string { return &c.Webhook.Bearer }),
+	stringOption("webhook-user", "имя пользователя HTTP-шлюза (Basic)", func(c *config) *string { return &c.Webhook.User }),
+	stringOption("webhook-password", "пароль HTTP-шлюза (Basic)", func(c *config) *string { return &c.Webhook.Password }),
+	stringOption("webhook-successpath", "путь к полю JSON-ответа, по которому проверяется успешная отправка, например status", func(c *config) *string { return &c.Webhook.SuccessPath }),
+	stringOption("webhook-successvalue", "значение поля -webhook-successpath при успешной отправке", func(c *config) *string { return &c.Webhook.SuccessValue }),
+	stringOption("webhook-messageidpath", "путь к идентификатору сообщения в JSON-ответе, например messages.0.id", func(c *config) *string { return &c.Webhook.MessageIDPath }),
+	stringOption("modem-device", "порт GSM-модема, например /dev/ttyUSB0; если задан, сообщения отправляются через модем", func(c *config) *string { return &c.Modem.Device }),
+	intOption("modem-baud", "скорость порта GSM-модема", func(c *config) *int { return &c.Modem.Baud }),
+	{name: "modem-textmode", usage: "отправлять короткие латинские сообщения в текстовом режиме модема (true/false)", set: func(c *config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("некорректное логическое значение '%v'", v)
+		}
+		c.Modem.TextMode = b
+		return nil
+	}},
+	stringOption("telegram-token", "токен бота Telegram для получателей tg:<chat_id>", func(c *config) *string { return &c.Telegram.Token }),
+	stringOption("email-addr", "адрес SMTP-сервера host:port для получателей mailto:<адрес>", func(c *config) *string { return &c.Email.Addr }),
+	stringOption("email-user", "имя пользователя SMTP", func(c *config) *string { return &c.Email.User }),
+	stringOption("email-password", "пароль SMTP", func(c *config) *string { return &c.Email.Password }),
+	stringOption("email-from", "адрес отправителя писем", func(c *config) *string { return &c.Email.From }),
+	stringOption("email-subject", "тема писем с напоминаниями", func(c *config) *string { return &c.Email.Subject }),
+	stringOption("matrix-homeserver", "адрес Matrix-сервера для получателей @user:server", func(c *config) *string { return &c.Matrix.Homeserver }),
+	stringOption("matrix-token", "токен доступа учетной записи Matrix", func(c *config) *string { return &c.Matrix.Token }),
+}
+
+func defaultConfig() config {
+	return config{
+		Location:        "Europe/Moscow",
+		Storage:         "tmp-caldavsms",
+		FirstToken:      "http://sabre.io/ns/sync/0",
+		MinTime:         "2024-01-01",
+		Interval:        "1m",
+		RetryBackoff:    "1m",
+		RetryDeadline:   "2h",
+		MissedPolicy:    "all",
+		MissedTolerance: "5m",
+		MissedGrace:     "1h",
+		Horizon:         "168h",
+		OutboxRetention: "720h",
+		AllDayTime:      "09:00",
+		QuietPolicy:     "none",
+		WindowPolicy:    "defer",
+		MaxSegments:     1,
+		SegmentPolicy:   "truncate",
+		Rate:            "6/m",
+		Burst:           1,
+		RecipientBurst:  1,
+		GoIP:            goipConfig{Line: 2},
+	}
+}
+
+// Функция регистрирует флаги параметров в наборе fs
+// Возвращает функцию, которая загружает конфигурацию после разбора флагов
+// Приоритет: значения по умолчанию, файл -config (или CALDAVSMS_CONFIG), переменные окружения, флаги
+func registerConfigFlags(fs *flag.FlagSet) func() (config, error) {
+	path := fs.String("config", "", "путь к файлу конфигурации в формате JSON")
+	values := make(map[string]*string, len(options))
+	for _, o := range options {
+		values[o.name] = fs.String(o.name, "", o.usage)
+	}
+	return func() (config, error) {
+		c := defaultConfig()
+		file := *path
+		if file == "" {
+			file = os.Getenv(envPrefix + "CONFIG")
+		}
+		if file != "" {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				return c, fmt.Errorf("Не удалось прочитать файл конфигурации: %w", err)
+			}
+			if err := json.Unmarshal(b, &c); err != nil {
+				return c, fmt.Errorf("Некорректный файл конфигурации %v: %w", file, err)
+			}
+		}
+		var errs []error
+		for _, o := range options {
+			env := envPrefix + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+			if v, ok := os.LookupEnv(env); ok {
+				if err := o.set(&c, v); err != nil {
+					errs = append(errs, fmt.Errorf("%v: %w", env, err))
+				}
+			}
+		}
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		for _, o := range options {
+			if set[o.name] {
+				if err := o.set(&c, *values[o.name]); err != nil {
+					errs = append(errs, fmt.Errorf("-%v: %w", o.name, err))
+				}
+			}
+		}
+		return c, errors.Join(errs...)
+	}
+}
+
+// Функция проверяет конфигурацию и возвращает Syncer или MultiSyncer, если заданы учетные записи
+// Возвращает все найденные ошибки сразу
+func (c config) newSyncer() (syncer, error) {
+	var errs []error
+	if len(c.Accounts) == 0 {
+		if c.Username == "" {
+			errs = append(errs, fmt.Errorf("не задано имя пользователя (username)"))
+		}
+		if len(c.Calendars) == 0 {
+			errs = append(errs, fmt.Errorf("не заданы имена календарей (calendars)"))
+		}
+	}
+	if u, err := url.Parse(c.URI); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("некорректный адрес CalDAV-сервиса (uri) '%v'", c.URI))
+	}
+	loc, err := time.LoadLocation(c.Location)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("некорректная локализация (location) '%v': %v", c.Location, err))
+		loc = time.UTC
+	}
+	mintime, err := parseTime(c.MinTime, loc)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("некорректное минимальное время (mintime): %v", err))
+	}
+	if c.Storage == "" {
+		errs = append(errs, fmt.Errorf("не задан каталог хранилища (storage)"))
+	}
+	if c.FirstToken == "" {
+		errs = append(errs, fmt.Errorf("не задан первоначальный токен синхронизации (firsttoken)"))
+	}
+	// общий шлюз нужен, если есть учетная запись без собственного шлюза
+	shared := len(c.Accounts) == 0
+	for _, a := range c.Accounts {
+		if a.GoIP == nil && a.SMPP == nil && a.Webhook == nil && a.Modem == nil {
+			shared = true
+		}
+	}
+	if shared && c.GoIP.Host == "" && c.SMPP.Addr == "" && c.Webhook.URL == "" && c.Modem.Device == "" &&
+		c.Telegram.Token == "" && c.Email.Addr == "" && c.Matrix.Homeserver == "" {
+		errs = append(errs, fmt.Errorf("не задан адрес шлюза GoIP (goip.host), SMPP-сервера (smpp.addr), HTTP-шлюза (webhook.url), порт модема (modem.device) или другой канал (telegram, email, matrix)"))
+	}
+	retryBackoff, err := parseDuration(c.RetryBackoff)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("некорректная пауза повторной отправки (retrybackoff): %v", err))
+	}
+	retryDeadline, err := parseDuration(c.RetryDeadline)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("некорректный срок повторных отправок (retrydeadline): %v", err))
+	}
+	missedPolicy, err := caldavsms.ParseMissedPolicy(c.MissedPolicy)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("missedpolicy: %v", err))
+	}
+	missedTolerance, err := parseDuration(c.MissedTolerance)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("некорректное опоздание пропущенного напоминания (missedtolerance): %v", err))
+	}
+	missedGrace, err := parseDuration(c.MissedGrace)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("некорректное допустимое опоздание (missedgrace): %v", err))
+	}
+	horizon, err := parseDuration(c.Horizon)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("некорректный период планирования (horizon): %v", err))
+	}
+	outboxRetention, err := parseDuration(c.OutboxRetention)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("некорректный срок хранения журнала отправки (outboxretention): %v", err))
+	}
+	allDayTime, err := parseClock(c.AllDayTime)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("некорректное время напоминаний событий на весь день (alldaytime): %v", err))
+	}
+	var quietFrom, quietTo time.Duration
+	if c.QuietHours != "" {
+		from, to, ok := strings.Cut(c.QuietHours, "-")
+		if quietFrom, err = parseClock(from); ok && err == nil {
+			quietTo, err = parseClock(to)
+		}
+		if !ok || err != nil {
+			errs = append(errs, fmt.Errorf("некорректные тихие часы (quiethours) '%v', ожидается вид 22:00-08:00", c.QuietHours))
+		}
+	}
+	quietPolicy, err := caldavsms.ParseQuietPolicy(c.QuietPolicy)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("quietpolicy: %v", err))
+	}
+	windows, err := parseWindows(c.Windows)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("некорректные окна доставки (windows): %v", err))
+	}
+	var holidays []time.Time
+	if loc, err := time.LoadLocation(c.Location); err == nil {
+		for _, h := range c.Holidays {
+			d, err := time.ParseInLocation("2006-01-02", h, loc)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("некорректный праздничный день (holidays) '%v', ожидается вид 2006-01-02", h))
+				continue
+			}
+			holidays = append(holidays, d)
+		}
+	}
+	windowPolicy, err := caldavsms.ParseWindowPolicy(c.WindowPolicy)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("windowpolicy: %v", err))
+	}
+	if c.MaxSegments < 1 || c.MaxSegments > 255 {
+		errs = append(errs, fmt.Errorf("maxsegments: количество частей SMS должно быть от 1 до 255"))
+	}
+	segmentPolicy, err := caldavsms.ParseSegmentPolicy(c.SegmentPolicy)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("segmentpolicy: %v", err))
+	}
+	limit := caldavsms.RateLimit{Burst: c.Burst}
+	if limit.Rate, err = caldavsms.ParseRate(c.Rate); err != nil {
+		errs = append(errs, fmt.Errorf("rate: %v", err))
+	}
+	recipientLimit := caldavsms.RateLimit{Burst: c.RecipientBurst}
+	if c.RecipientRate != "" {
+		if recipientLimit.Rate, err = caldavsms.ParseRate(c.RecipientRate); err != nil {
+			errs = append(errs, fmt.Errorf("recipientrate: %v", err))
+		}
+	}
+	// каждый шлюз получает свое ограничение скорости, общее для всех учетных записей, которые через него отправляют
+	limited := func(s caldavsms.Sender) caldavsms.Sender {
+		if s == nil || (limit.Rate == 0 && recipientLimit.Rate == 0) {
+			return s
+		}
+		return caldavsms.NewRateLimitedSender(s, limit, recipientLimit)
+	}
+	// SMPP-шлюзы, отчеты о доставке которых записываются в очередь сообщений
+	var receipts []*caldavsms.SMPPSender
+	// шлюз выбирается в порядке SMPP, HTTP, модем, GoIP; nil - шлюз не задан
+	gateway := func(g *goipConfig, p *smppConfig, w *webhookConfig, m *modemConfig) (caldavsms.Sender, error) {
+		switch {
+		case p != nil:
+			if p.Addr == "" {
+				return nil, fmt.Errorf("не задан адрес SMPP-сервера (smpp.addr)")
+			}
+			sender, err := p.sender()
+			if err != nil {
+				return nil, err
+			}
+			if p.Receipts {
+				receipts = append(receipts, sender)
+			}
+			return sender, nil
+		case w != nil:
+			if w.URL == "" {
+				return nil, fmt.Errorf("не задан адрес HTTP-шлюза (webhook.url)")
+			}
+			return w.sender()
+		case m != nil:
+			if m.Device == "" {
+				return nil, fmt.Errorf("не задан порт модема (modem.device)")
+			}
+			return m.sender(), nil
+		case g != nil:
+			if g.Host == "" {
+				return nil, fmt.Errorf("не задан адрес шлюза GoIP (goip.host)")
+			}
+			return g.sender()
+		}
+		return nil, nil
+	}
+	var (
+		goip    *goipConfig
+		smpp    *smppConfig
+		webhook *webhookConfig
+		modem   *modemConfig
+	)
+	if c.GoIP.Host != "" {
+		goip = &c.GoIP
+	}
+	if c.SMPP.Addr != "" {
+		smpp = &c.SMPP
+	}
+	if c.Webhook.URL != "" {
+		webhook = &c.Webhook
+	}
+	if c.Modem.Device != "" {
+		modem = &c.Modem
+	}
+	sender, err := gateway(goip, smpp, webhook, modem)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	channels, err := c.channels()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	// сообщения получателям других каналов направляются в их шлюзы, SMS - в шлюз учетной записи
+	route := func(sms caldavsms.Sender) caldavsms.Sender {
+		if channels == nil {
+			return sms
+		}
+		cs := *channels
+		cs.SMS = sms
+		return &cs
+	}
+	var accounts []caldavsms.Account
+	for i, a := range c.Accounts {
+		if a.Username == "" {
+			errs = append(errs, fmt.Errorf("accounts[%v]: не задано имя пользователя (username)", i))
+		}
+		if len(a.Calendars) == 0 && len(c.Calendars) == 0 {
+			errs = append(errs, fmt.Errorf("accounts[%v]: не заданы имена календарей (calendars)", i))
+		}
+		if a.Location != "" {
+			if _, err := time.LoadLocation(a.Location); err != nil {
+				errs = append(errs, fmt.Errorf("accounts[%v]: некорректная локализация (location) '%v': %v", i, a.Location, err))
+			}
+		}
+		account := caldavsms.Account{Username: a.Username, Password: a.Password, Calendars: a.Calendars, Location: a.Location}
+		if sender, err := gateway(a.GoIP, a.SMPP, a.Webhook, a.Modem); err != nil {
+			errs = append(errs, fmt.Errorf("accounts[%v]: %w", i, err))
+		} else if sender != nil {
+			account.Sender = route(limited(sender))
+		}
+		accounts = append(accounts, account)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	cfg := caldavsms.Config{
+		Username:        c.Username,
+		Password:        c.Password,
+		URI:             c.URI,
+		Calendars:       c.Calendars,
+		Location:        c.Location,
+		StorageName:     c.Storage,
+		FirstToken:      c.FirstToken,
+		MinTime:         mintime,
+		Sender:          route(limited(sender)),
+		DryRun:          c.DryRun,
+		RetryBackoff:    retryBackoff,
+		RetryDeadline:   retryDeadline,
+		MissedPolicy:    missedPolicy,
+		MissedTolerance: missedTolerance,
+		MissedGrace:     missedGrace,
+		Horizon:         horizon,
+		OutboxRetention: outboxRetention,
+		Actions:         c.Actions,
+		AllDayTime:      &allDayTime,
+		QuietFrom:       quietFrom,
+		QuietTo:         quietTo,
+		QuietPolicy:     quietPolicy,
+		DeliveryWindows: windows,
+		Holidays:        holidays,
+		WindowPolicy:    windowPolicy,
+		MaxSegments:     c.MaxSegments,
+		SegmentPolicy:   segmentPolicy,
+	}
+	var s syncer
+	if len(accounts) != 0 {
+		m, err := caldavsms.NewMultiSyncer(cfg, accounts)
+		if err != nil {
+			return nil, err
+		}
+		s = m
+	} else {
+		single, err := caldavsms.NewSyncer(cfg)
+		if err != nil {
+			return nil, err
+		}
+		s = single
+	}
+	for _, p := range receipts {
+		p.RegisteredDelivery = true
+		// отчет записывается отдельно, чтобы не задерживать чтение SMPP-сессии на время синхронизации
+		p.OnReceipt = func(r caldavsms.DeliveryReceipt) {
+			go func() {
+				if ok, err := s.ApplyReceipt(r); err != nil {
+					log.Println(err)
+				} else if !ok {
+					log.Printf("Отчет о доставке %v на %v: сообщение не найдено", r.MessageID, r.Phone)
+				}
+			}()
+		}
+	}
+	return s, nil
+}
+
+// Функция возвращает шлюзы каналов Telegram, email и Matrix или nil, если ни один канал не задан
+func (c config) channels() (*caldavsms.ChannelSender, error) {
+	var cs caldavsms.ChannelSender
+	var errs []error
+	if c.Telegram.Token != "" {
+		t := caldavsms.NewTelegramSender(c.Telegram.Token)
+		if c.Telegram.APIURL != "" {
+			t.APIURL = c.Telegram.APIURL
+		}
+		cs.Telegram = t
+	}
+	if c.Email.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Email.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("некорректный адрес SMTP-сервера (email.addr) '%v', ожидается host:port", c.Email.Addr))
+		}
+		if _, err := mail.ParseAddress(c.Email.From); err != nil {
+			errs = append(errs, fmt.Errorf("некорректный адрес отправителя писем (email.from) '%v'", c.Email.From))
+		}
+		e := caldavsms.NewEmailSender(c.Email.Addr, c.Email.User, c.Email.Password, c.Email.From)
+		if c.Email.Subject != "" {
+			e.Subject = c.Email.Subject
+		}
+		cs.Email = e
+	}
+	if c.Matrix.Homeserver != "" {
+		if c.Matrix.Token == "" {
+			errs = append(errs, fmt.Errorf("не задан токен доступа Matrix (matrix.token)"))
+		}
+		cs.Matrix = caldavsms.NewMatrixSender(c.Matrix.Homeserver, c.Matrix.Token)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if cs.Telegram == nil && cs.Email == nil && cs.Matrix == nil {
+		return nil, nil
+	}
+	return &cs, nil
+}
+
+// Функция возвращает GSM-модем
+func (m modemConfig) sender() caldavsms.Sender {
+	sender := caldavsms.NewModemSender(m.Device, m.Baud)
+	sender.TextMode = m.TextMode
+	return sender
+}
+
+// Функция возвращает HTTP-шлюз
+func (w webhookConfig) sender() (caldavsms.Sender, error) {
+	sender, err := caldavsms.NewWebhookSender(w.Method, w.URL, w.Body)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %v", err)
+	}
+	for k, v := range w.Headers {
+		sender.Header.Set(k, v)
+	}
+	sender.BearerToken = w.Bearer
+	sender.User = w.User
+	sender.Password = w.Password
+	sender.SuccessStatus = w.SuccessStatus
+	sender.SuccessPath = w.SuccessPath
+	sender.SuccessValue = w.SuccessValue
+	sender.MessageIDPath = w.MessageIDPath
+	return sender, nil
+}
+
+// Функция возвращает SMPP-шлюз
+func (p smppConfig) sender() (*caldavsms.SMPPSender, error) {
+	sender := caldavsms.NewSMPPSender(p.Addr, p.SystemID, p.Password, p.Source)
+	sender.SystemType = p.SystemType
+	if p.EnquireLink != "" {
+		d, err := parseDuration(p.EnquireLink)
+		if err != nil {
+			return nil, fmt.Errorf("некорректный период проверки SMPP-соединения (smpp.enquirelink): %v", err)
+		}
+		sender.EnquireLink = d
+	}
+	return sender, nil
+}
+
+// Функция возвращает шлюз GoIP
+// Если заданы линии, сообщения распределяются по ним с ограничениями скорости каждой линии
+func (g goipConfig) sender() (caldavsms.Sender, error) {
+	if len(g.Lines) == 0 {
+		return g.line(goipLineConfig{Line: g.Line}), nil
+	}
+	var errs []error
+	var lines []*caldavsms.Line
+	for i, l := range g.Lines {
+		if l.Concurrency < 0 {
+			errs = append(errs, fmt.Errorf("goip.lines[%v]: количество одновременных отправок (concurrency) не может быть отрицательным", i))
+		}
+		line := &caldavsms.Line{Name: strconv.Itoa(l.Line), Sender: g.line(l), Concurrency: l.Concurrency}
+		if l.Host != "" && l.Host != g.Host {
+			line.Name = l.Host + "/" + line.Name
+		}
+		if l.Rate != "" {
+			rate, err := caldavsms.ParseRate(l.Rate)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("goip.lines[%v].rate: %v", i, err))
+			}
+			if l.Burst < 0 {
+				errs = append(errs, fmt.Errorf("goip.lines[%v]: количество сообщений подряд (burst) не может быть отрицательным", i))
+			}
+			if rate > 0 {
+				line.Sender = caldavsms.NewRateLimitedSender(line.Sender, caldavsms.RateLimit{Rate: rate, Burst: l.Burst}, caldavsms.RateLimit{})
+			}
+		}
+		lines = append(lines, line)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return caldavsms.NewMultiLineSender(lines...)
+}
+
+// Функция возвращает шлюз GoIP для линии l
+func (g goipConfig) line(l goipLineConfig) *caldavsms.GoIPSender {
+	host, user, password := g.Host, g.User, g.Password
+	if l.Host != "" {
+		host = l.Host
+	}
+	if l.User != "" {
+		user = l.User
+	}
+	if l.Password != "" {
+		password = l.Password
+	}
+	sender := caldavsms.NewGoIPSender(host, user, password, l.Line)
+	if g.Template != "" {
+		sender.Template = g.Template
+	}
+	return sender
+}
+
+// Функция возвращает интервал опроса календаря в режиме демона
+func (c config) interval() (time.Duration, error) {
+	d, err := parseDuration(c.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("некорректный интервал опроса (interval): %v", err)
+	}
+	return d, nil
+}
+
+// Функция разбирает положительную длительность вида "90s", "5m", "2h"
+func parseDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("'%v' не является положительной длительностью вида 90s, 5m, 2h", v)
+	}
+	return d, nil
+}
+
+// Функция разбирает время в форматах 2006-01-02, 2006-01-02T15:04:05 (в локализации loc) и RFC 3339
+func parseTime(v string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("'%v' не соответствует форматам 2006-01-02, 2006-01-02T15:04:05 или RFC 3339", v)
+}
+
+// Функция разбирает окна доставки вида "mon-fri 09:00-20:00; sat,sun 10:00-18:00"
+// Окончание окна 24:00 означает конец суток
+func parseWindows(v string) ([]caldavsms.DeliveryWindow, error) {
+	weekdays := []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	day := func(name string) (int, error) {
+		for i, d := range weekdays {
+			if strings.EqualFold(d, name) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("неизвестный день недели '%v'", name)
+	}
+	var result []caldavsms.DeliveryWindow
+	for _, spec := range strings.Split(v, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		fields := strings.Fields(spec)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("'%v': ожидается вид mon-fri 09:00-20:00", strings.TrimSpace(spec))
+		}
+		var w caldavsms.DeliveryWindow
+		for _, r := range strings.Split(fields[0], ",") {
+			first, last, isRange := strings.Cut(r, "-")
+			from, err := day(first)
+			if err != nil {
+				return nil, err
+			}
+			to := from
+			if isRange {
+				if to, err = day(last); err != nil {
+					return nil, err
+				}
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				w.Days = append(w.Days, time.Weekday(d))
+				if d == to {
+					break
+				}
+			}
+		}
+		from, to, ok := strings.Cut(fields[1], "-")
+		if !ok {
+			return nil, fmt.Errorf("'%v': ожидается интервал вида 09:00-20:00", fields[1])
+		}
+		var err error
+		if w.From, err = parseClock(from); err != nil {
+			return nil, err
+		}
+		if to == "24:00" {
+			w.To = 24 * time.Hour
+		} else if w.To, err = parseClock(to); err != nil {
+			return nil, err
+		}
+		result = append(result, w)
+	}
+	return result, nil
+}
+
+// Функция разбирает время суток вида 15:04
+func parseClock(v string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if err != nil {
+		return 0, fmt.Errorf("'%v' не является временем суток вида 15:04", v)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Функция разбирает список значений через запятую
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
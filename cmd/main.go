@@ -1,25 +1,77 @@
 package main
 
 import (
-	"caldavsms"
-	"time"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-const (
-	username     = "XXX"
-	password     = "XXX"
-	uri          = "http://XXX.XXX.XXX.XXX:8080/baikal/html/dav.php"
-	calendarname = "XXX"
-	location     = "Europe/Moscow"
-	storagename  = "tmp-caldavsms"
-	firsttoken   = "http://sabre.io/ns/sync/0"
-)
+const usage = `Использование:
+  caldavsms [sync] [флаги]    синхронизировать календарь и отправить сообщения
+  caldavsms upcoming [флаги]  вывести запланированные сообщения из хранилища
+
+Флаги команды: caldavsms <команда> -h
+`
 
 func main() {
-	loc, err := time.LoadLocation(location)
+	args := os.Args[1:]
+	cmd := "sync"
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "sync":
+		runSync(args)
+	case "upcoming":
+		runUpcoming(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// Команда синхронизации календаря и отправки сообщений
+func runSync(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	daemon := fs.Bool("daemon", false, "работать постоянно, опрашивая календарь с интервалом -interval")
+	dryRun := fs.Bool("dry-run", false, "рассчитать и вывести сообщения к отправке, ничего не отправляя")
+	load := registerConfigFlags(fs)
+	fs.Parse(args)
+
+	c, err := load()
 	if err != nil {
-		panic(err)
+		fail(err)
 	}
-	var mintime = time.Date(2024, time.Month(1), 1, 0, 0, 0, 0, loc)
-	caldavsms.Sync(username, password, uri, calendarname, location, storagename, firsttoken, mintime)
+	if *daemon && *dryRun {
+		fail(fmt.Errorf("флаги -daemon и -dry-run несовместимы: в режиме демона сообщения отправляются"))
+	}
+	c.DryRun = *dryRun
+	s, err := c.newSyncer()
+	if err != nil {
+		fail(err)
+	}
+	if *daemon {
+		interval, err := c.interval()
+		if err != nil {
+			fail(err)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := s.Run(ctx, interval); err != nil {
+			fail(err)
+		}
+		return
+	}
+	if err := s.Sync(context.Background()); err != nil {
+		fail(err)
+	}
+}
+
+// Функция выводит ошибку конфигурации или синхронизации и завершает программу
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "caldavsms:", err)
+	os.Exit(1)
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"caldavsms"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Команда вывода запланированных сообщений из хранилища
+func runUpcoming(args []string) {
+	fs := flag.NewFlagSet("upcoming", flag.ExitOnError)
+	limit := fs.Int("n", 20, "количество сообщений, 0 - все")
+	phone := fs.String("phone", "", "только сообщения на этот номер")
+	uid := fs.String("uid", "", "только сообщения события с этим UID")
+	from := fs.String("from", "", "только сообщения не раньше этого времени")
+	to := fs.String("to", "", "только сообщения раньше этого времени")
+	asJSON := fs.Bool("json", false, "вывести в формате JSON")
+	width := fs.Int("width", 40, "максимальная длина выводимого текста сообщения")
+	load := registerConfigFlags(fs)
+	fs.Parse(args)
+
+	c, err := load()
+	if err != nil {
+		fail(err)
+	}
+	loc, err := time.LoadLocation(c.Location)
+	if err != nil {
+		fail(err)
+	}
+	f := caldavsms.UpcomingFilter{Phone: *phone, Uid: *uid, Limit: *limit}
+	if *from != "" {
+		if f.From, err = parseTime(*from, loc); err != nil {
+			fail(fmt.Errorf("-from: %w", err))
+		}
+	}
+	if *to != "" {
+		if f.To, err = parseTime(*to, loc); err != nil {
+			fail(fmt.Errorf("-to: %w", err))
+		}
+	}
+	s, err := c.newSyncer()
+	if err != nil {
+		fail(err)
+	}
+	us, err := s.Upcoming(f)
+	if err != nil {
+		fail(err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(us); err != nil {
+			fail(err)
+		}
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tACCOUNT\tPHONES\tTEXT\tSEGMENTS\tOBJECT")
+	for _, u := range us {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", u.DateTime.Format("2006-01-02 15:04"), u.Account, strings.Join(u.Phones, ","), truncate(u.Text, *width), u.Segments, u.Path)
+	}
+	tw.Flush()
+}
+
+// Функция обрезает текст до n символов
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if n <= 0 || len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
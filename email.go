@@ -0,0 +1,131 @@
+package caldavsms
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Тема письма по умолчанию
+const emailDefaultSubject = "Напоминание"
+
+// EmailSender отправляет сообщения письмом через SMTP-сервер
+// На порту 465 используется TLS-соединение, на остальных - STARTTLS, если сервер его поддерживает
+type EmailSender struct {
+	// Адрес сервера host:port
+	Addr     string
+	User     string
+	Password string
+	From     string
+	Subject  string
+	Timeout  time.Duration
+}
+
+// Функция возвращает SMTP-шлюз с темой письма по умолчанию
+func NewEmailSender(addr, user, password, from string) *EmailSender {
+	return &EmailSender{Addr: addr, User: user, Password: password, From: from, Subject: emailDefaultSubject, Timeout: 30 * time.Second}
+}
+
+func (e *EmailSender) Send(ctx context.Context, to, text string) (*Delivery, error) {
+	host, port, err := net.SplitHostPort(e.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Некорректный адрес SMTP-сервера '%v': %v", e.Addr, err)
+	}
+	from, err := mail.ParseAddress(e.From)
+	if err != nil {
+		return nil, fmt.Errorf("Некорректный адрес отправителя '%v': %v", e.From, err)
+	}
+	id := messageID(host)
+	msg := e.message(from, to, text, id)
+
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", e.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Не удалось подключиться к SMTP-серверу: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if port == "465" {
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SMTP-сервер: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && port != "465" {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return nil, fmt.Errorf("SMTP-сервер: %w", err)
+		}
+	}
+	if e.User != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.User, e.Password, host)); err != nil {
+			return nil, fmt.Errorf("SMTP-сервер отклонил авторизацию: %w", err)
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return nil, fmt.Errorf("SMTP-сервер: %w", err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return nil, fmt.Errorf("SMTP-сервер не принял получателя %v: %w", to, err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return nil, fmt.Errorf("SMTP-сервер: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return nil, fmt.Errorf("SMTP-сервер: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("SMTP-сервер не принял письмо: %w", err)
+	}
+	c.Quit()
+	return &Delivery{MessageID: id}, nil
+}
+
+// Функция формирует письмо: текст в UTF-8 (base64), тема и имя отправителя в кодировке MIME
+func (e *EmailSender) message(from *mail.Address, to, text, id string) []byte {
+	subject := e.Subject
+	if subject == "" {
+		subject = emailDefaultSubject
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %v\r\n", from.String())
+	fmt.Fprintf(&b, "To: %v\r\n", to)
+	fmt.Fprintf(&b, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: %v\r\n", id)
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(text))
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+	return b.Bytes()
+}
+
+// Функция возвращает уникальный Message-ID письма
+func messageID(host string) string {
+	r := make([]byte, 12)
+	rand.Read(r)
+	return fmt.Sprintf("<%v.%v@%v>", time.Now().UnixNano(), hex.EncodeToString(r), strings.Trim(host, "[]"))
+}
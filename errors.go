@@ -0,0 +1,47 @@
+package caldavsms
+
+import "errors"
+
+var (
+	// ErrAuth - CalDAV-сервер отклонил имя пользователя или пароль
+	ErrAuth = errors.New("Ошибка авторизации на CalDAV-сервере")
+	// ErrCalendarNotFound - календарь с заданным именем не найден
+	ErrCalendarNotFound = errors.New("Календарь не найден")
+	// ErrStorage - ошибка чтения, записи или несогласованность данных хранилища
+	ErrStorage = errors.New("Ошибка хранилища")
+	// ErrClockBeforeMintime - текущее время меньше минимального допустимого
+	ErrClockBeforeMintime = errors.New("Текущее время меньше минимального допустимого")
+	// ErrInvalidTrigger - не удалось разобрать TRIGGER напоминания
+	ErrInvalidTrigger = errors.New("Некорректный TRIGGER напоминания")
+	// ErrInvalidTime - не удалось разобрать дату/время или часовой пояс
+	ErrInvalidTime = errors.New("Некорректное значение даты/времени")
+	// ErrDeliveryFailed - сообщение не удалось передать шлюзу до истечения срока повторов
+	ErrDeliveryFailed = errors.New("Сообщение не отправлено")
+	// ErrLocked - хранилище используется другим процессом синхронизации
+	ErrLocked = errors.New("Хранилище используется другим процессом")
+	// ErrRateLimited - превышено ограничение скорости отправки
+	ErrRateLimited = errors.New("Превышено ограничение скорости отправки")
+	// ErrPartialDelivery - шлюз принял только часть составного сообщения; повторная отправка
+	// продублировала бы принятые части, поэтому сообщение не повторяется
+	ErrPartialDelivery = errors.New("Составное сообщение отправлено частично")
+)
+
+// SyncError - ошибка этапа синхронизации
+// Исходная ошибка доступна через errors.Is/errors.As
+type SyncError struct {
+	Op  string
+	Err error
+}
+
+func (e *SyncError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+// Функция оборачивает ошибку этапа синхронизации
+func syncError(op string, err error) error {
+	return &SyncError{Op: op, Err: err}
+}
@@ -5,9 +5,8 @@ go 1.21.3
 require (
 	github.com/Snawoot/go-http-digest-auth-client v1.1.3
 	github.com/dylanmei/iso8601 v0.1.0
+	github.com/emersion/go-ical v0.0.0-20220601085725-0864dccc089f
 	github.com/emersion/go-webdav v0.5.0
 	github.com/sonyarouje/simdb v0.1.0
 	github.com/teambition/rrule-go v1.8.2
 )
-
-require github.com/emersion/go-ical v0.0.0-20220601085725-0864dccc089f // indirect
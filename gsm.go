@@ -0,0 +1,103 @@
+package caldavsms
+
+import "unicode/utf16"
+
+// Основной алфавит GSM 03.38: символ с индексом n кодируется септетом n
+// Септет 0x1B (ESC) - переход к таблице расширения
+var gsm7Basic = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// Таблица расширения GSM 03.38: символы кодируются парой септетов ESC и значение
+var gsm7Extension = map[rune]byte{
+	'\f': 0x0A, '^': 0x14, '{': 0x28, '}': 0x29, '\\': 0x2F, '[': 0x3C, '~': 0x3D, ']': 0x3E, '|': 0x40, '€': 0x65,
+}
+
+var gsm7Index = func() map[rune]byte {
+	m := make(map[rune]byte, len(gsm7Basic))
+	for i, r := range gsm7Basic {
+		if r != 0x1b {
+			m[r] = byte(i)
+		}
+	}
+	return m
+}()
+
+// Функция кодирует текст алфавитом GSM 7-бит, по септету в байте (без упаковки)
+// Второе значение равно false, если текст содержит символы вне алфавита GSM
+func encodeGSM7(text string) ([]byte, bool) {
+	result := make([]byte, 0, len(text))
+	for _, r := range text {
+		if b, ok := gsm7Index[r]; ok {
+			result = append(result, b)
+		} else if b, ok := gsm7Extension[r]; ok {
+			result = append(result, 0x1b, b)
+		} else {
+			return nil, false
+		}
+	}
+	return result, true
+}
+
+// Функция кодирует текст в UCS-2 (UTF-16BE), символы вне BMP передаются суррогатными парами
+func encodeUCS2(text string) []byte {
+	units := utf16.Encode([]rune(text))
+	result := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		result = append(result, byte(u>>8), byte(u))
+	}
+	return result
+}
+
+// Размер сообщения: одиночного и части составного (за вычетом заголовка UDH)
+const (
+	gsm7SingleLen = 160
+	gsm7PartLen   = 153
+	ucs2SingleLen = 140
+	ucs2PartLen   = 134
+)
+
+// Функция кодирует текст и делит его на части SMS: септеты GSM 7-бит (без упаковки) или октеты UCS-2
+// Символ таблицы расширения и суррогатная пара UTF-16 не разрываются между частями
+func splitMessage(text string) (bool, [][]byte) {
+	data, ok := encodeGSM7(text)
+	single, part := gsm7SingleLen, gsm7PartLen
+	if !ok {
+		data = encodeUCS2(text)
+		single, part = ucs2SingleLen, ucs2PartLen
+	}
+	ucs2 := !ok
+	if len(data) <= single {
+		return ucs2, [][]byte{data}
+	}
+	var parts [][]byte
+	for len(data) > 0 {
+		n := part
+		if n >= len(data) {
+			n = len(data)
+		} else if !ucs2 && data[n-1] == 0x1b {
+			n--
+		} else if ucs2 && data[n-2] >= 0xD8 && data[n-2] <= 0xDB {
+			n -= 2
+		}
+		parts = append(parts, data[:n])
+		data = data[n:]
+	}
+	return ucs2, parts
+}
+
+// Функция упаковывает септеты GSM 7-бит в октеты, начиная с fill заполняющих битов
+// (заполнение выравнивает данные по септетам после заголовка UDH)
+func packGSM7(septets []byte, fill int) []byte {
+	bits := fill + 7*len(septets)
+	result := make([]byte, (bits+7)/8)
+	pos := fill
+	for _, s := range septets {
+		for i := 0; i < 7; i++ {
+			if s&(1<<i) != 0 {
+				result[pos/8] |= 1 << (pos % 8)
+			}
+			pos++
+		}
+	}
+	return result
+}
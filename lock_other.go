@@ -0,0 +1,8 @@
+//go:build !unix
+
+package caldavsms
+
+// На платформах без flock блокировка хранилища не выполняется
+func lockStorage(storagename string) (func(), error) {
+	return func() {}, nil
+}
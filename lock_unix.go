@@ -0,0 +1,31 @@
+//go:build unix
+
+package caldavsms
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Функция захватывает файловую блокировку хранилища, чтобы одновременно запущенные процессы
+// (например, пересекающиеся запуски cron) не отправляли одни и те же сообщения
+// Возвращает функцию освобождения блокировки
+func lockStorage(storagename string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(storagename, ".lock"), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
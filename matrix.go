@@ -0,0 +1,156 @@
+package caldavsms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MatrixSender отправляет сообщения в Matrix через client-server API от имени пользователя с токеном AccessToken
+// Получатель - комната (!room:server) или пользователь (@user:server). Для пользователя используется личная комната
+// из данных m.direct учетной записи; если ее нет, комната создается с приглашением пользователя и записывается в m.direct.
+type MatrixSender struct {
+	// Адрес сервера, например https://matrix.example.org
+	Homeserver  string
+	AccessToken string
+	Client      *http.Client
+
+	mu     sync.Mutex
+	userID string
+	direct map[string]string
+	txn    atomic.Uint64
+}
+
+// Функция возвращает Matrix-шлюз сервера homeserver
+func NewMatrixSender(homeserver, token string) *MatrixSender {
+	return &MatrixSender{Homeserver: homeserver, AccessToken: token}
+}
+
+func (m *MatrixSender) Send(ctx context.Context, to, text string) (*Delivery, error) {
+	room := to
+	if strings.HasPrefix(to, "@") {
+		var err error
+		if room, err = m.directRoom(ctx, to); err != nil {
+			return nil, err
+		}
+	}
+	txn := fmt.Sprintf("caldavsms-%d-%d", time.Now().UnixNano(), m.txn.Add(1))
+	var resp struct {
+		EventID string `json:"event_id"`
+	}
+	status, err := m.request(ctx, http.MethodPut, "/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/send/m.room.message/"+txn,
+		map[string]string{"msgtype": "m.text", "body": text}, &resp)
+	d := &Delivery{Status: status, MessageID: resp.EventID}
+	if err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+// Функция возвращает личную комнату с пользователем user, при необходимости создавая ее
+func (m *MatrixSender) directRoom(ctx context.Context, user string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.userID == "" {
+		var whoami struct {
+			UserID string `json:"user_id"`
+		}
+		if _, err := m.request(ctx, http.MethodGet, "/_matrix/client/v3/account/whoami", nil, &whoami); err != nil {
+			return "", err
+		}
+		m.userID = whoami.UserID
+	}
+	directPath := "/_matrix/client/v3/user/" + url.PathEscape(m.userID) + "/account_data/m.direct"
+	if m.direct == nil {
+		var direct map[string][]string
+		status, err := m.request(ctx, http.MethodGet, directPath, nil, &direct)
+		if err != nil && status != http.StatusNotFound {
+			return "", err
+		}
+		m.direct = make(map[string]string)
+		for u, rooms := range direct {
+			if len(rooms) > 0 {
+				m.direct[u] = rooms[0]
+			}
+		}
+	}
+	if room := m.direct[user]; room != "" {
+		return room, nil
+	}
+	var created struct {
+		RoomID string `json:"room_id"`
+	}
+	if _, err := m.request(ctx, http.MethodPost, "/_matrix/client/v3/createRoom",
+		map[string]interface{}{"invite": []string{user}, "is_direct": true, "preset": "trusted_private_chat"}, &created); err != nil {
+		return "", err
+	}
+	m.direct[user] = created.RoomID
+	// m.direct перечитывается целиком, чтобы не потерять комнаты, добавленные другими клиентами
+	var direct map[string][]string
+	if status, err := m.request(ctx, http.MethodGet, directPath, nil, &direct); err != nil && status != http.StatusNotFound {
+		return created.RoomID, nil
+	}
+	if direct == nil {
+		direct = make(map[string][]string)
+	}
+	direct[user] = append([]string{created.RoomID}, direct[user]...)
+	m.request(ctx, http.MethodPut, directPath, direct, nil)
+	return created.RoomID, nil
+}
+
+// Функция выполняет запрос к client-server API и разбирает JSON-ответ в result
+// Возвращает статус ответа; ошибки API возвращаются с кодом errcode
+func (m *MatrixSender) request(ctx context.Context, method, path string, body, result interface{}) (int, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(m.Homeserver, "/")+path, r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.AccessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c := m.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Errcode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.Unmarshal(respBody, &apiErr)
+		if apiErr.Errcode != "" {
+			return resp.StatusCode, fmt.Errorf("Matrix-сервер: %v: %v", apiErr.Errcode, apiErr.Error)
+		}
+		return resp.StatusCode, fmt.Errorf("Matrix-сервер вернул статус %v", resp.Status)
+	}
+	if result != nil {
+		if err := json.Unmarshal(respBody, result); err != nil {
+			return resp.StatusCode, fmt.Errorf("Некорректный ответ Matrix-сервера: %v", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,71 @@
+package caldavsms
+
+import (
+	"fmt"
+	"time"
+)
+
+// MissedPolicy - правило обработки пропущенных напоминаний, например, за время простоя сервиса
+type MissedPolicy int
+
+const (
+	// Отправлять все пропущенные напоминания
+	MissedSendAll MissedPolicy = iota
+	// Отправлять пропущенные напоминания, опоздание которых не больше MissedGrace, остальные пропускать
+	MissedSendWithinGrace
+	// Не отправлять пропущенные напоминания
+	MissedDrop
+)
+
+// Значения по умолчанию для пропущенных напоминаний
+const (
+	defaultMissedTolerance = 5 * time.Minute
+	defaultMissedGrace     = time.Hour
+)
+
+// Максимальное количество проходов расчета просроченных напоминаний за одну синхронизацию
+const maxCatchUpPasses = 1000
+
+func (p MissedPolicy) String() string {
+	switch p {
+	case MissedSendAll:
+		return "all"
+	case MissedSendWithinGrace:
+		return "grace"
+	case MissedDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("MissedPolicy(%d)", int(p))
+	}
+}
+
+// Функция разбирает правило обработки пропущенных напоминаний: "all", "grace" или "drop"
+func ParseMissedPolicy(v string) (MissedPolicy, error) {
+	for _, p := range []MissedPolicy{MissedSendAll, MissedSendWithinGrace, MissedDrop} {
+		if p.String() == v {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Некорректное правило обработки пропущенных напоминаний '%v', допустимы all, grace, drop", v)
+}
+
+// Функция проверяет, нужно ли отправлять напоминание со временем scheduled в момент t
+// Напоминание считается пропущенным, если опоздание больше MissedTolerance.
+// Если отправлять не нужно, возвращает причину.
+func (s *Syncer) missedDecision(scheduled, t time.Time) (bool, string) {
+	late := t.Sub(scheduled)
+	if late <= s.cfg.MissedTolerance {
+		return true, ""
+	}
+	switch s.cfg.MissedPolicy {
+	case MissedSendWithinGrace:
+		if late <= s.cfg.MissedGrace {
+			return true, ""
+		}
+		return false, fmt.Sprintf("напоминание пропущено: опоздание %v больше допустимого %v", late.Round(time.Second), s.cfg.MissedGrace)
+	case MissedDrop:
+		return false, fmt.Sprintf("напоминание пропущено: опоздание %v", late.Round(time.Second))
+	default:
+		return true, ""
+	}
+}
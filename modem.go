@@ -0,0 +1,452 @@
+package caldavsms
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Значения по умолчанию для GSM-модема
+const (
+	defaultModemTimeout = 30 * time.Second
+	defaultModemBaud    = 115200
+)
+
+// Описания кодов +CMS ERROR (3GPP TS 27.005)
+var cmsErrors = map[int]string{
+	1:   "номер не назначен",
+	8:   "оператор запретил отправку",
+	10:  "вызов запрещен",
+	21:  "сообщение отклонено",
+	27:  "получатель недоступен",
+	28:  "некорректный формат номера",
+	38:  "сеть не работает",
+	41:  "временная ошибка сети",
+	42:  "перегрузка сети",
+	47:  "ресурсы недоступны",
+	50:  "услуга не подключена",
+	69:  "услуга не поддерживается",
+	96:  "некорректное сообщение",
+	300: "ошибка модема",
+	301: "служба SMS модема занята",
+	302: "операция не разрешена",
+	303: "операция не поддерживается",
+	304: "некорректный параметр режима PDU",
+	305: "некорректный параметр текстового режима",
+	310: "SIM-карта не вставлена",
+	311: "требуется PIN-код SIM-карты",
+	312: "требуется PH-SIM PIN",
+	313: "ошибка SIM-карты",
+	314: "SIM-карта занята",
+	315: "неверная SIM-карта",
+	316: "требуется PUK-код SIM-карты",
+	320: "ошибка памяти",
+	321: "некорректный индекс памяти",
+	322: "память заполнена",
+	330: "неизвестен адрес SMS-центра",
+	331: "нет сети",
+	332: "истекло время ожидания сети",
+	340: "не ожидается подтверждение +CNMA",
+	500: "неизвестная ошибка",
+}
+
+// ModemError - модем вернул ошибку ERROR, +CMS ERROR или +CME ERROR
+type ModemError struct {
+	// CMS, CME или пусто для ERROR без кода
+	Kind string
+	Code int
+	Text string
+}
+
+func (e *ModemError) Error() string {
+	if e.Kind == "" {
+		return fmt.Sprintf("Модем вернул ERROR на %v", e.Text)
+	}
+	if desc := cmsErrors[e.Code]; e.Kind == "CMS" && desc != "" {
+		return fmt.Sprintf("Модем вернул +CMS ERROR: %v (%v)", e.Code, desc)
+	}
+	if e.Text != "" {
+		return fmt.Sprintf("Модем вернул +%v ERROR: %v", e.Kind, e.Text)
+	}
+	return fmt.Sprintf("Модем вернул +%v ERROR: %v", e.Kind, e.Code)
+}
+
+// ModemSender отправляет SMS через GSM-модем AT-командами
+// Короткие сообщения в алфавите GSM при TextMode отправляются в текстовом режиме (AT+CMGF=1),
+// остальные - в режиме PDU (AT+CMGF=0), длинные сообщения - составными (concatenated SMS).
+// После ошибки ввода-вывода порт открывается заново при следующей отправке.
+type ModemSender struct {
+	// Функция открытия порта модема; порт может быть любым io.ReadWriteCloser, например имитацией в тестах
+	Open func() (io.ReadWriteCloser, error)
+	// Отправлять короткие сообщения в текстовом режиме
+	TextMode bool
+	// Срок ожидания ответа модема на команду
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	conn *modemConn
+	ref  byte
+}
+
+// Функция возвращает модем на последовательном порту device со скоростью baud (0 - 115200)
+func NewModemSender(device string, baud int) *ModemSender {
+	if baud == 0 {
+		baud = defaultModemBaud
+	}
+	return &ModemSender{Open: func() (io.ReadWriteCloser, error) { return OpenSerialPort(device, baud) }, Timeout: defaultModemTimeout}
+}
+
+func (m *ModemSender) Send(ctx context.Context, phone, text string) (*Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		conn, err := m.open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		m.conn = conn
+	}
+	refs, err := m.send(ctx, phone, text)
+	var modemErr *ModemError
+	if err != nil && !errors.As(err, &modemErr) {
+		// порт или модем в неизвестном состоянии: открываем заново при следующей отправке
+		m.conn.close()
+		m.conn = nil
+	}
+	d := &Delivery{MessageID: strings.Join(refs, ",")}
+	if err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+// Функция закрывает порт модема
+func (m *ModemSender) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return nil
+	}
+	err := m.conn.close()
+	m.conn = nil
+	return err
+}
+
+func (m *ModemSender) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	return defaultModemTimeout
+}
+
+// Функция открывает порт и настраивает модем: отключает эхо и включает числовые коды ошибок
+func (m *ModemSender) open(ctx context.Context) (*modemConn, error) {
+	if m.Open == nil {
+		return nil, fmt.Errorf("Не задан порт модема")
+	}
+	port, err := m.Open()
+	if err != nil {
+		return nil, fmt.Errorf("Не удалось открыть порт модема: %w", err)
+	}
+	conn := newModemConn(port, m.timeout())
+	// ESC отменяет ввод текста сообщения, если модем остался в нем после прерванной отправки
+	if _, err := io.WriteString(port, "\x1b"); err != nil {
+		conn.close()
+		return nil, fmt.Errorf("Не удалось открыть порт модема: %w", err)
+	}
+	for _, cmd := range []string{"AT", "ATE0", "AT+CMEE=1"} {
+		if _, err := conn.command(ctx, cmd); err != nil {
+			conn.close()
+			return nil, fmt.Errorf("Модем не ответил на %v: %w", cmd, err)
+		}
+	}
+	return conn, nil
+}
+
+// Функция отправляет сообщение целиком или по частям и возвращает номера (TP-MR) отправленных частей
+// Если модем не принял часть после уже принятых, возвращается ErrPartialDelivery: повтор продублировал бы принятые части
+func (m *ModemSender) send(ctx context.Context, phone, text string) ([]string, error) {
+	ucs2, parts := splitMessage(text)
+	if m.TextMode && !ucs2 && len(parts) == 1 && isPrintableASCII(text) {
+		if _, err := m.conn.command(ctx, "AT+CMGF=1"); err != nil {
+			return nil, err
+		}
+		ref, err := m.conn.submit(ctx, fmt.Sprintf("AT+CMGS=%q", phone), text)
+		if err != nil {
+			return nil, err
+		}
+		return []string{ref}, nil
+	}
+	if _, err := m.conn.command(ctx, "AT+CMGF=0"); err != nil {
+		return nil, err
+	}
+	m.ref++
+	var refs []string
+	for i, part := range parts {
+		pdu := submitPDU(phone, ucs2, part, m.ref, len(parts), i+1)
+		// длина PDU без адреса SMS-центра (первый октет 00)
+		ref, err := m.conn.submit(ctx, "AT+CMGS="+strconv.Itoa(len(pdu)-1), strings.ToUpper(hex.EncodeToString(pdu)))
+		if err != nil {
+			if len(refs) > 0 {
+				return refs, fmt.Errorf("%w: часть %v из %v: %w", ErrPartialDelivery, i+1, len(parts), err)
+			}
+			if len(parts) > 1 {
+				return refs, fmt.Errorf("часть %v из %v: %w", i+1, len(parts), err)
+			}
+			return refs, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// Функция формирует PDU SMS-SUBMIT (3GPP TS 23.040) с адресом SMS-центра по умолчанию
+// Части составного сообщения (total > 1) получают заголовок UDH с номером ref, частью seq из total
+func submitPDU(phone string, ucs2 bool, data []byte, ref byte, total, seq int) []byte {
+	var b bytes.Buffer
+	// адрес SMS-центра из настроек SIM-карты
+	b.WriteByte(0x00)
+	first := byte(0x01)
+	if total > 1 {
+		first |= 0x40
+	}
+	b.WriteByte(first)
+	// TP-MR назначает модем
+	b.WriteByte(0x00)
+	number := strings.TrimPrefix(phone, "+")
+	b.WriteByte(byte(len(number)))
+	if strings.HasPrefix(phone, "+") {
+		b.WriteByte(0x91)
+	} else {
+		b.WriteByte(0x81)
+	}
+	b.Write(semiOctets(number))
+	// TP-PID, TP-DCS
+	b.WriteByte(0x00)
+	if ucs2 {
+		b.WriteByte(0x08)
+	} else {
+		b.WriteByte(0x00)
+	}
+	var udh []byte
+	if total > 1 {
+		udh = []byte{0x05, 0x00, 0x03, ref, byte(total), byte(seq)}
+	}
+	if ucs2 {
+		b.WriteByte(byte(len(udh) + len(data)))
+		b.Write(udh)
+		b.Write(data)
+		return b.Bytes()
+	}
+	// длина в септетах: заголовок с заполнением до границы септета и текст
+	headerSeptets := (len(udh)*8 + 6) / 7
+	b.WriteByte(byte(headerSeptets + len(data)))
+	b.Write(udh)
+	b.Write(packGSM7(data, headerSeptets*7-len(udh)*8))
+	return b.Bytes()
+}
+
+// Функция кодирует цифры номера полуоктетами: попарно переставленные, нечетное количество дополняется F
+func semiOctets(number string) []byte {
+	if len(number)%2 != 0 {
+		number += "F"
+	}
+	result := make([]byte, 0, len(number)/2)
+	for i := 0; i < len(number); i += 2 {
+		result = append(result, nibble(number[i+1])<<4|nibble(number[i]))
+	}
+	return result
+}
+
+func nibble(c byte) byte {
+	if c >= '0' && c <= '9' {
+		return c - '0'
+	}
+	return 0x0F
+}
+
+// Функция проверяет, что текст можно передать модему в текстовом режиме без перекодировки
+func isPrintableASCII(text string) bool {
+	for _, r := range text {
+		if r > 0x7e || (r < 0x20 && r != '\n' && r != '\r') {
+			return false
+		}
+	}
+	return true
+}
+
+// Порт модема: данные читаются отдельной горутиной, чтобы ожидание ответа можно было прервать по сроку
+type modemConn struct {
+	port    io.ReadWriteCloser
+	timeout time.Duration
+	data    chan []byte
+	done    chan struct{}
+	err     error
+	buf     []byte
+}
+
+func newModemConn(port io.ReadWriteCloser, timeout time.Duration) *modemConn {
+	c := &modemConn{port: port, timeout: timeout, data: make(chan []byte), done: make(chan struct{})}
+	go func() {
+		for {
+			b := make([]byte, 256)
+			n, err := port.Read(b)
+			if n > 0 {
+				select {
+				case c.data <- b[:n]:
+				case <-c.done:
+					return
+				}
+			}
+			if err != nil {
+				c.err = err
+				close(c.data)
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *modemConn) close() error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	close(c.done)
+	return c.port.Close()
+}
+
+// Функция ждет, пока в прочитанных данных не появится ответ, который находит функция final
+// final возвращает длину ответа в буфере или -1
+func (c *modemConn) wait(ctx context.Context, final func(buf []byte) int) ([]byte, error) {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	for {
+		if n := final(c.buf); n >= 0 {
+			resp := c.buf[:n]
+			c.buf = append([]byte(nil), c.buf[n:]...)
+			return resp, nil
+		}
+		select {
+		case b, ok := <-c.data:
+			if !ok {
+				return nil, fmt.Errorf("Порт модема закрыт: %v", c.err)
+			}
+			c.buf = append(c.buf, b...)
+		case <-timer.C:
+			return nil, fmt.Errorf("Модем не ответил за %v", c.timeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Функция отправляет команду и возвращает строки ответа до OK
+// Ответы ERROR, +CMS ERROR и +CME ERROR возвращаются ошибкой
+func (c *modemConn) command(ctx context.Context, cmd string) ([]string, error) {
+	c.buf = nil
+	if _, err := io.WriteString(c.port, cmd+"\r"); err != nil {
+		return nil, err
+	}
+	resp, err := c.wait(ctx, finalResult)
+	if err != nil {
+		return nil, err
+	}
+	return parseResult(resp, cmd)
+}
+
+// Функция отправляет команду AT+CMGS, после приглашения "> " передает данные с Ctrl-Z и возвращает номер сообщения из +CMGS
+func (c *modemConn) submit(ctx context.Context, cmd, data string) (string, error) {
+	c.buf = nil
+	if _, err := io.WriteString(c.port, cmd+"\r"); err != nil {
+		return "", err
+	}
+	resp, err := c.wait(ctx, func(buf []byte) int {
+		if i := bytes.Index(buf, []byte("> ")); i >= 0 {
+			return i + 2
+		}
+		return finalResult(buf)
+	})
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasSuffix(resp, []byte("> ")) {
+		_, err := parseResult(resp, cmd)
+		if err == nil {
+			err = fmt.Errorf("Модем не запросил текст сообщения")
+		}
+		return "", err
+	}
+	if _, err := io.WriteString(c.port, data+"\x1a"); err != nil {
+		return "", err
+	}
+	resp, err = c.wait(ctx, finalResult)
+	if err != nil {
+		return "", err
+	}
+	lines, err := parseResult(resp, cmd)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range lines {
+		if v, ok := strings.CutPrefix(l, "+CMGS:"); ok {
+			return strings.TrimSpace(v), nil
+		}
+	}
+	return "", nil
+}
+
+// Функция находит в буфере завершающую строку ответа: OK, ERROR, +CMS ERROR или +CME ERROR
+func finalResult(buf []byte) int {
+	pos := 0
+	for {
+		i := bytes.IndexByte(buf[pos:], '\n')
+		if i < 0 {
+			return -1
+		}
+		line := strings.TrimSpace(string(buf[pos : pos+i]))
+		pos += i + 1
+		if line == "OK" || line == "ERROR" || strings.HasPrefix(line, "+CMS ERROR:") || strings.HasPrefix(line, "+CME ERROR:") {
+			return pos
+		}
+	}
+}
+
+// Функция разбирает ответ модема на строки; эхо команды cmd и пустые строки пропускаются
+func parseResult(resp []byte, cmd string) ([]string, error) {
+	var lines []string
+	for _, l := range strings.Split(string(resp), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || l == cmd || l == ">" {
+			continue
+		}
+		for _, kind := range []string{"CMS", "CME"} {
+			if v, ok := strings.CutPrefix(l, "+"+kind+" ERROR:"); ok {
+				v = strings.TrimSpace(v)
+				code, err := strconv.Atoi(v)
+				if err != nil {
+					return lines, &ModemError{Kind: kind, Code: -1, Text: v}
+				}
+				return lines, &ModemError{Kind: kind, Code: code}
+			}
+		}
+		if l == "ERROR" {
+			return lines, &ModemError{Text: cmd}
+		}
+		if l == "OK" {
+			return lines, nil
+		}
+		lines = append(lines, l)
+	}
+	return lines, nil
+}
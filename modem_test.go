@@ -0,0 +1,285 @@
+package caldavsms
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Имитация GSM-модема на последовательном порту: отвечает OK на команды, на AT+CMGS запрашивает данные
+// приглашением "> " и после Ctrl-Z отвечает +CMGS с номером сообщения или ошибкой submitErr
+type fakeModem struct {
+	submitErr string
+
+	mu       sync.Mutex
+	in       []byte
+	inData   bool
+	commands []string
+	data     []string
+	ref      int
+	out      chan []byte
+	pending  []byte
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newFakeModem() *fakeModem {
+	return &fakeModem{out: make(chan []byte, 16), closed: make(chan struct{})}
+}
+
+func (f *fakeModem) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.in = append(f.in, p...)
+	for {
+		if f.inData {
+			i := bytes.IndexByte(f.in, 0x1a)
+			if i < 0 {
+				return len(p), nil
+			}
+			f.data = append(f.data, string(f.in[:i]))
+			f.in = f.in[i+1:]
+			f.inData = false
+			if f.submitErr != "" {
+				f.out <- []byte("\r\n" + f.submitErr + "\r\n")
+			} else {
+				f.ref++
+				f.out <- []byte("\r\n+CMGS: " + string(rune('0'+f.ref)) + "\r\n\r\nOK\r\n")
+			}
+			continue
+		}
+		i := bytes.IndexByte(f.in, '\r')
+		if i < 0 {
+			return len(p), nil
+		}
+		cmd := strings.TrimLeft(string(f.in[:i]), "\x1b")
+		f.in = f.in[i+1:]
+		f.commands = append(f.commands, cmd)
+		if strings.HasPrefix(cmd, "AT+CMGS=") {
+			f.inData = true
+			f.out <- []byte("\r\n> ")
+		} else {
+			f.out <- []byte("\r\nOK\r\n")
+		}
+	}
+}
+
+func (f *fakeModem) Read(p []byte) (int, error) {
+	if len(f.pending) == 0 {
+		select {
+		case b := <-f.out:
+			f.pending = b
+		case <-f.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func (f *fakeModem) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakeModem) sent() (commands, data []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...), append([]string(nil), f.data...)
+}
+
+// Функция возвращает ModemSender, открывающий имитацию модема, и счетчик открытий порта
+func newFakeModemSender(f *fakeModem) (*ModemSender, *int) {
+	opens := 0
+	return &ModemSender{Open: func() (io.ReadWriteCloser, error) {
+		opens++
+		return f, nil
+	}, Timeout: 2 * time.Second}, &opens
+}
+
+func TestSubmitPDU(t *testing.T) {
+	tests := []struct {
+		phone string
+		text  string
+		want  string
+	}{
+		// известный пример PDU SMS-SUBMIT
+		{"+46708251358", "hellohello", "0001000B916407281553F800000AE8329BFD4697D9EC37"},
+		{"89001234567", "Test", "0001000B819800214365F7000004D4F29C0E"},
+		{"+79001234567", "Привет", "0001000B919700214365F700080C041F04400438043204350442"},
+	}
+	for _, tt := range tests {
+		ucs2, parts := splitMessage(tt.text)
+		if len(parts) != 1 {
+			t.Fatalf("%q: частей %v", tt.text, len(parts))
+		}
+		got := strings.ToUpper(hex.EncodeToString(submitPDU(tt.phone, ucs2, parts[0], 0, 1, 1)))
+		if got != tt.want {
+			t.Errorf("%q: PDU %v, ожидается %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+// Функция распаковывает count септетов, начиная с fill заполняющих битов
+func unpackGSM7(b []byte, fill, count int) []byte {
+	result := make([]byte, count)
+	pos := fill
+	for i := range result {
+		for j := 0; j < 7; j++ {
+			if b[pos/8]&(1<<(pos%8)) != 0 {
+				result[i] |= 1 << j
+			}
+			pos++
+		}
+	}
+	return result
+}
+
+func TestSubmitPDUConcatenated(t *testing.T) {
+	text := strings.Repeat("0123456789", 20)
+	ucs2, parts := splitMessage(text)
+	if ucs2 || len(parts) != 2 || len(parts[0]) != gsm7PartLen {
+		t.Fatalf("разбиение: ucs2 %v, частей %v", ucs2, len(parts))
+	}
+	var got []byte
+	for i, part := range parts {
+		pdu := submitPDU("+79001234567", false, part, 0x2A, len(parts), i+1)
+		// SCA, первый октет, TP-MR, адрес (длина, тип, 6 октетов), TP-PID, TP-DCS, затем TP-UDL и данные
+		if pdu[1] != 0x41 {
+			t.Errorf("часть %v: первый октет %#x, ожидается TP-UDHI (0x41)", i+1, pdu[1])
+		}
+		ud := pdu[13:]
+		// длина в септетах: UDH из 6 октетов занимает 7 септетов (1 бит заполнения)
+		if int(ud[0]) != 7+len(part) {
+			t.Errorf("часть %v: TP-UDL %v, ожидается %v", i+1, ud[0], 7+len(part))
+		}
+		if udh := []byte{0x05, 0x00, 0x03, 0x2A, 0x02, byte(i + 1)}; !bytes.Equal(ud[1:7], udh) {
+			t.Errorf("часть %v: UDH % x, ожидается % x", i+1, ud[1:7], udh)
+		}
+		if ud[7]&0x01 != 0 {
+			t.Errorf("часть %v: бит заполнения не равен нулю", i+1)
+		}
+		got = append(got, unpackGSM7(ud[7:], 1, len(part))...)
+	}
+	if string(got) != text {
+		t.Errorf("текст частей %q, ожидается %q", got, text)
+	}
+}
+
+func TestModemSenderPDU(t *testing.T) {
+	f := newFakeModem()
+	m, opens := newFakeModemSender(f)
+	defer m.Close()
+
+	d, err := m.Send(context.Background(), "+79001234567", strings.Repeat("Длинное напоминание. ", 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.MessageID != "1,2" {
+		t.Errorf("MessageID = %q, ожидаются номера частей 1,2", d.MessageID)
+	}
+	commands, data := f.sent()
+	want := []string{"AT", "ATE0", "AT+CMEE=1", "AT+CMGF=0", "AT+CMGS=153", "AT+CMGS=95"}
+	if strings.Join(commands, "|") != strings.Join(want, "|") {
+		t.Errorf("команды %q, ожидаются %q", commands, want)
+	}
+	if len(data) != 2 || !strings.HasPrefix(data[0], "0041000B919700214365F70008") {
+		t.Errorf("PDU частей %q", data)
+	}
+	if *opens != 1 {
+		t.Errorf("порт открыт %v раз", *opens)
+	}
+}
+
+func TestModemSenderTextMode(t *testing.T) {
+	f := newFakeModem()
+	m, _ := newFakeModemSender(f)
+	m.TextMode = true
+	defer m.Close()
+
+	if _, err := m.Send(context.Background(), "+79001234567", "Reminder: 10:00"); err != nil {
+		t.Fatal(err)
+	}
+	commands, data := f.sent()
+	if got := strings.Join(commands[3:], "|"); got != `AT+CMGF=1|AT+CMGS="+79001234567"` {
+		t.Errorf("команды %v", got)
+	}
+	if len(data) != 1 || data[0] != "Reminder: 10:00" {
+		t.Errorf("текст %q", data)
+	}
+}
+
+func TestModemSenderCMSError(t *testing.T) {
+	f := newFakeModem()
+	f.submitErr = "+CMS ERROR: 38"
+	m, opens := newFakeModemSender(f)
+	defer m.Close()
+
+	_, err := m.Send(context.Background(), "89001234567", "test")
+	var modemErr *ModemError
+	if !errors.As(err, &modemErr) || modemErr.Kind != "CMS" || modemErr.Code != 38 {
+		t.Fatalf("ошибка %v, ожидается +CMS ERROR 38", err)
+	}
+	if !strings.Contains(err.Error(), cmsErrors[38]) {
+		t.Errorf("ошибка %q без описания кода", err)
+	}
+	// ошибка модема не требует открывать порт заново
+	f.mu.Lock()
+	f.submitErr = ""
+	f.mu.Unlock()
+	if _, err := m.Send(context.Background(), "89001234567", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if *opens != 1 {
+		t.Errorf("порт открыт %v раз, ожидается 1", *opens)
+	}
+}
+
+// Имитация модема, отклоняющая части сообщения начиная с failFrom
+type partialModem struct {
+	*fakeModem
+	failFrom int
+}
+
+func (p *partialModem) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	if len(p.data) >= p.failFrom-1 {
+		p.submitErr = "+CMS ERROR: 42"
+	}
+	p.mu.Unlock()
+	return p.fakeModem.Write(b)
+}
+
+func TestModemSenderPartialDelivery(t *testing.T) {
+	f := &partialModem{fakeModem: newFakeModem(), failFrom: 2}
+	m := &ModemSender{Open: func() (io.ReadWriteCloser, error) { return f, nil }, Timeout: 2 * time.Second}
+	defer m.Close()
+
+	d, err := m.Send(context.Background(), "89001234567", strings.Repeat("0123456789", 20))
+	if !errors.Is(err, ErrPartialDelivery) {
+		t.Fatalf("ошибка %v, ожидается ErrPartialDelivery", err)
+	}
+	if d == nil || d.MessageID != "1" {
+		t.Errorf("номера принятых частей %+v, ожидается 1", d)
+	}
+
+	// сообщение с принятыми частями не отправляется повторно
+	s := newTestSyncer(t, func(cfg *Config) { cfg.Sender = &testSender{errs: []error{err}} })
+	now := time.Now()
+	if err := s.enqueueMessages([]message{{Phone: "89001234567", Text: "t", Calendar: "cal", Uid: "e", DateTime: now}}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.dispatch(context.Background(), now); !errors.Is(err, ErrDeliveryFailed) {
+		t.Fatalf("ошибка отправки %v, ожидается ErrDeliveryFailed", err)
+	}
+	if os, _ := s.driver.getOutboxDB(); len(os) != 1 || os[0].State != OutboxFailed {
+		t.Errorf("сообщение в очереди %+v, ожидается состояние failed", os)
+	}
+}
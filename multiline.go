@@ -0,0 +1,122 @@
+package caldavsms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Line - линия (SIM-порт) шлюза для MultiLineSender
+type Line struct {
+	// Имя линии, записывается в очередь сообщений как линия отправки
+	Name string
+	// Шлюз отправки через линию; ограничение скорости линии задается оберткой RateLimitedSender
+	Sender Sender
+	// Количество одновременных отправок через линию, по умолчанию 1
+	Concurrency int
+
+	slots chan struct{}
+}
+
+// MultiLineSender распределяет сообщения по нескольким линиям одного или нескольких шлюзов
+// Сообщение отправляется через свободную линию; если линия вернула ошибку, сообщение отправляется через следующую.
+// Линия, через которую отправлено сообщение, возвращается в Delivery.Line.
+type MultiLineSender struct {
+	mu    sync.Mutex
+	lines []*Line
+	next  int
+}
+
+// Шлюз, через который можно отправлять несколько сообщений одновременно
+type concurrent interface {
+	Concurrency() int
+}
+
+// Функция возвращает шлюз, распределяющий сообщения по линиям lines
+func NewMultiLineSender(lines ...*Line) (*MultiLineSender, error) {
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("Не заданы линии шлюза")
+	}
+	for _, l := range lines {
+		if l.Sender == nil {
+			return nil, fmt.Errorf("Не задан шлюз линии %v", l.Name)
+		}
+		n := l.Concurrency
+		if n < 1 {
+			n = 1
+		}
+		l.slots = make(chan struct{}, n)
+	}
+	return &MultiLineSender{lines: lines}, nil
+}
+
+// Функция возвращает количество одновременных отправок через все линии
+func (m *MultiLineSender) Concurrency() int {
+	n := 0
+	for _, l := range m.lines {
+		n += cap(l.slots)
+	}
+	return n
+}
+
+// Функция занимает свободную линию из candidates, начиная с очередной по кругу, и ждет освобождения, если свободных нет
+func (m *MultiLineSender) acquire(ctx context.Context, candidates []*Line) (*Line, error) {
+	m.mu.Lock()
+	start := m.next
+	m.next++
+	m.mu.Unlock()
+	for i := range candidates {
+		l := candidates[(start+i)%len(candidates)]
+		select {
+		case l.slots <- struct{}{}:
+			return l, nil
+		default:
+		}
+	}
+	cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}}
+	for _, l := range candidates {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(l.slots), Send: reflect.ValueOf(struct{}{})})
+	}
+	chosen, _, _ := reflect.Select(cases)
+	if chosen == 0 {
+		return nil, ctx.Err()
+	}
+	return candidates[chosen-1], nil
+}
+
+func (m *MultiLineSender) Send(ctx context.Context, phone, text string) (*Delivery, error) {
+	candidates := append([]*Line(nil), m.lines...)
+	var errs []error
+	for len(candidates) > 0 {
+		l, err := m.acquire(ctx, candidates)
+		if err != nil {
+			return nil, errors.Join(append(errs, err)...)
+		}
+		d, err := l.Sender.Send(ctx, phone, text)
+		<-l.slots
+		if d != nil && l.Name != "" {
+			d.Line = l.Name
+		}
+		if err == nil {
+			return d, nil
+		}
+		errs = append(errs, fmt.Errorf("линия %v: %w", l.Name, err))
+		// часть составного сообщения уже принята: другая линия продублировала бы ее
+		if ctx.Err() != nil || errors.Is(err, ErrPartialDelivery) {
+			return d, errors.Join(errs...)
+		}
+		// переключаемся на другую линию
+		for i, c := range candidates {
+			if c == l {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+		if len(candidates) == 0 {
+			return d, errors.Join(errs...)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
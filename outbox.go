@@ -0,0 +1,414 @@
+package caldavsms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	db "github.com/sonyarouje/simdb"
+)
+
+// Состояния исходящего сообщения
+// Сообщение переводится в OutboxSending до передачи шлюзу: если процесс прервется во время отправки,
+// сообщение не будет отправлено повторно
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+	OutboxDropped = "dropped"
+)
+
+// Значения по умолчанию для повторной отправки
+const (
+	defaultRetryBackoff  = time.Minute
+	defaultRetryDeadline = 2 * time.Hour
+	// Срок хранения обработанных сообщений по умолчанию
+	defaultOutboxRetention = 30 * 24 * time.Hour
+)
+
+// Исходящее сообщение: создается для каждого номера при наступлении напоминания
+// и хранит результат передачи шлюзу. Записи служат журналом отправленных напоминаний
+// и удаляются через OutboxRetention после времени напоминания (см. pruneOutbox).
+type outbox struct {
+	Id          string    `json:"id"`
+	Calendar    string    `json:"calendar"`
+	Uid         string    `json:"uid"`
+	UidTrigger  string    `json:"uidtrigger"`
+	Repeat      int       `json:"repeat"`
+	Occurrence  time.Time `json:"occurrence"`
+	DateTime    time.Time `json:"datetime"`
+	Phone       string    `json:"phone"`
+	Text        string    `json:"text"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lasterror"`
+	HTTPStatus  int       `json:"httpstatus"`
+	NextAttempt time.Time `json:"nextattempt"`
+	SentAt      time.Time `json:"sentat"`
+	// Открытие окна доставки, до которого отложено сообщение
+	DeferredTo time.Time `json:"deferredto"`
+	// Линия шлюза, через которую передано сообщение, и идентификатор сообщения у оператора
+	Line      string `json:"line"`
+	MessageId string `json:"messageid"`
+	// Состояние из отчета о доставке оператора (DELIVRD, UNDELIV и т. д.)
+	Receipt string `json:"receipt"`
+	// Количество частей SMS, 0 - сообщение другого канала
+	Segments int `json:"segments"`
+}
+
+func (o outbox) ID() (jsonField string, value interface{}) {
+	{
+		value = o.Id
+		jsonField = "id"
+		return
+	}
+}
+
+// Функция возвращает ключ исходящего сообщения: напоминание и номер
+// Напоминание о конкретном повторении события отправляется на номер не более одного раза
+func (m message) outboxKey() string {
+	return taskKey(m.Calendar, m.Uid, m.UidTrigger, m.Occurrence, m.Repeat) + "|" + m.Phone
+}
+
+// Функция возвращает исходящее сообщение по ключу
+func (driver *driver) getOutboxByIdDB(key string) (*outbox, bool) {
+	var existing []outbox
+	if err := driver.Driver.Open(outbox{}).Where("id", "=", key).Get().AsEntity(&existing); err != nil || len(existing) == 0 {
+		return nil, false
+	}
+	return &existing[0], true
+}
+
+// Функция возвращает время, от которого отсчитываются опоздание и срок повторов сообщения:
+// запланированное время или открытие окна доставки, до которого сообщение было отложено
+func (o outbox) scheduled() time.Time {
+	if o.DeferredTo.After(o.DateTime) {
+		return o.DeferredTo
+	}
+	return o.DateTime
+}
+
+// Функция помещает сообщения в очередь на отправку в момент t
+// Уже поставленные в очередь (в том числе отправленные) сообщения не изменяются.
+// Пропущенные напоминания по правилу MissedPolicy сохраняются в состоянии OutboxDropped.
+func (s *Syncer) enqueueMessages(ms []message, t time.Time) error {
+	result, err := s.driver.getOutboxDB()
+	if err != nil {
+		return err
+	}
+	queued := make(map[string]bool, len(result)+len(ms))
+	for _, o := range result {
+		queued[o.Id] = true
+	}
+	n := len(result)
+	for _, m := range ms {
+		key := m.outboxKey()
+		if queued[key] {
+			continue
+		}
+		queued[key] = true
+		o := outbox{Id: key, Calendar: m.Calendar, Uid: m.Uid, UidTrigger: m.UidTrigger, Repeat: m.Repeat, Occurrence: m.Occurrence, DateTime: m.DateTime,
+			Phone: m.Phone, Text: m.Text, State: OutboxPending, NextAttempt: t, Segments: m.Segments}
+		if m.Segments > s.maxSegments() {
+			o.State = OutboxDropped
+			o.LastError = fmt.Sprintf("сообщение из %v частей SMS длиннее допустимого (%v)", m.Segments, s.maxSegments())
+			s.cfg.Logger.Printf("Сообщение на %v, событие %v, время %v не отправлено: %v", o.Phone, o.Uid, o.DateTime.In(s.location).Format("2006-01-02 15:04"), o.LastError)
+		} else if send, reason := s.missedDecision(m.DateTime, t); !send {
+			o.State = OutboxDropped
+			o.LastError = reason
+			s.cfg.Logger.Printf("Сообщение на %v, событие %v, время %v не отправлено: %v", o.Phone, o.Uid, o.DateTime.In(s.location).Format("2006-01-02 15:04"), reason)
+		}
+		result = append(result, o)
+	}
+	if len(result) == n {
+		return nil
+	}
+	return s.driver.writeAllDB(result)
+}
+
+// Функция удаляет из журнала обработанные сообщения, время напоминания которых старше OutboxRetention к моменту t
+// Ожидающие отправки и отправляемые сообщения не удаляются.
+func (s *Syncer) pruneOutbox(t time.Time) error {
+	result, err := s.driver.getOutboxDB()
+	if err != nil {
+		return err
+	}
+	cutoff := t.Add(-s.cfg.OutboxRetention)
+	kept := result[:0]
+	for _, o := range result {
+		last := o.scheduled()
+		if o.Occurrence.After(last) {
+			last = o.Occurrence
+		}
+		if o.State == OutboxPending || o.State == OutboxSending || !last.Before(cutoff) {
+			kept = append(kept, o)
+		}
+	}
+	if len(kept) == len(result) {
+		return nil
+	}
+	return s.driver.writeAllDB(kept)
+}
+
+// Функция получает из БД все исходящие сообщения
+func (driver *driver) getOutboxDB() ([]outbox, error) {
+	var result []outbox
+	if err := driver.Driver.Open(outbox{}).AsEntity(&result); err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	return result, nil
+}
+
+// Функция возвращает ожидающие отправки сообщения, время попытки которых наступило к моменту t
+func (driver *driver) getOutboxDue(t time.Time) ([]outbox, error) {
+	result, err := driver.getOutboxDB()
+	if err != nil {
+		return nil, err
+	}
+	var due []outbox
+	for _, o := range result {
+		if o.State == OutboxPending && !o.NextAttempt.After(t) {
+			due = append(due, o)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].DateTime.Before(due[j].DateTime)
+	})
+	return due, nil
+}
+
+// Функция возвращает время ближайшей попытки отправки
+func (driver *driver) getNextOutboxTime() (time.Time, bool, error) {
+	result, err := driver.getOutboxDB()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	var next time.Time
+	for _, o := range result {
+		if o.State == OutboxPending && (next.IsZero() || o.NextAttempt.Before(next)) {
+			next = o.NextAttempt
+		}
+	}
+	return next, !next.IsZero(), nil
+}
+
+// Функция помечает как неотправленные сообщения, отправка которых была прервана
+// Такие сообщения могли быть доставлены, поэтому повторно не отправляются
+func (s *Syncer) recoverOutbox() error {
+	result, err := s.driver.getOutboxDB()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, o := range result {
+		if o.State != OutboxSending {
+			continue
+		}
+		o.State = OutboxFailed
+		o.LastError = "отправка прервана, сообщение могло быть доставлено"
+		if err := s.driver.Driver.Upsert(o); err != nil {
+			return fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		errs = append(errs, fmt.Errorf("%w: %v, событие %v: %v", ErrDeliveryFailed, o.Phone, o.Uid, o.LastError))
+	}
+	return errors.Join(errs...)
+}
+
+// Функция возвращает паузу перед попыткой отправки с номером attempts+1: RetryBackoff, удваиваемый с каждой попыткой
+func (s *Syncer) retryBackoff(attempts int) time.Duration {
+	d := s.cfg.RetryBackoff
+	for i := 1; i < attempts && d < s.cfg.RetryDeadline; i++ {
+		d *= 2
+	}
+	return d
+}
+
+// Функция отправляет ожидающие сообщения, выдерживая ограничения скорости шлюза (см. RateLimitedSender)
+// Сообщения вне окон доставки откладываются до открытия окна или не отправляются по правилу WindowPolicy.
+// Неудачные попытки повторяются с экспоненциальной паузой до истечения RetryDeadline от запланированного времени,
+// после чего сообщение помечается как неотправленное и возвращается ошибка ErrDeliveryFailed.
+// Частично отправленное составное сообщение (ErrPartialDelivery) не повторяется.
+// Если шлюз допускает одновременные отправки (см. MultiLineSender), сообщения отправляются параллельно;
+// хранилище при этом захватывается только на время чтения и записи сообщений (см. dispatchMessage).
+func (s *Syncer) dispatch(ctx context.Context, t time.Time) error {
+	s.store.Lock()
+	due, err := s.driver.getOutboxDue(t)
+	s.store.Unlock()
+	if err != nil {
+		return err
+	}
+	workers := 1
+	if c, ok := s.cfg.Sender.(concurrent); ok && c.Concurrency() > 1 {
+		workers = c.Concurrency()
+	}
+	var (
+		mu       sync.Mutex
+		errs     []error
+		canceled bool
+		wg       sync.WaitGroup
+	)
+	slots := make(chan struct{}, workers)
+loop:
+	for _, o := range due {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			canceled = true
+			mu.Unlock()
+			break loop
+		case slots <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(o outbox) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := s.dispatchMessage(ctx, o); err != nil {
+				mu.Lock()
+				if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+					canceled = true
+				} else {
+					errs = append(errs, err)
+				}
+				mu.Unlock()
+			}
+		}(o)
+	}
+	wg.Wait()
+	if canceled {
+		errs = append(errs, ctx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+// Функция отправляет одно ожидающее сообщение и сохраняет результат
+// Хранилище захватывается только на время чтения и записи сообщения, ожидание и отправка идут без блокировки
+func (s *Syncer) dispatchMessage(ctx context.Context, o outbox) error {
+	if ok, err := s.prepareMessage(&o); !ok || err != nil {
+		return err
+	}
+	sendCtx, err := waitSender(ctx, s.cfg.Sender, o.Phone)
+	var rateErr *RateLimitError
+	if errors.As(err, &rateErr) {
+		o.LastError = err.Error()
+		o.NextAttempt = time.Now().Add(rateErr.RetryAfter)
+		return s.saveMessage(o)
+	} else if err != nil {
+		return err
+	}
+	o.State = OutboxSending
+	if err := s.saveMessage(o); err != nil {
+		return err
+	}
+	// начатая отправка доводится до конца и после отмены ctx
+	sendCtx = WithMessageInfo(context.WithoutCancel(sendCtx), MessageInfo{Calendar: o.Calendar, Uid: o.Uid, UidTrigger: o.UidTrigger,
+		Repeat: o.Repeat, Occurrence: o.Occurrence, DateTime: o.DateTime})
+	d, err := s.cfg.Sender.Send(sendCtx, o.Phone, o.Text)
+	o.Attempts++
+	if d != nil {
+		o.HTTPStatus = d.Status
+		o.Line = d.Line
+		o.MessageId = d.MessageID
+	}
+	now := time.Now()
+	var result error
+	if err == nil {
+		o.State = OutboxSent
+		o.LastError = ""
+		o.SentAt = now
+	} else {
+		o.State = OutboxPending
+		o.LastError = err.Error()
+		o.NextAttempt = now.Add(s.retryBackoff(o.Attempts))
+		if errors.Is(err, ErrPartialDelivery) || o.NextAttempt.After(o.scheduled().Add(s.cfg.RetryDeadline)) {
+			o.State = OutboxFailed
+			result = fmt.Errorf("%w: %v, событие %v, попыток %v: %v", ErrDeliveryFailed, o.Phone, o.Uid, o.Attempts, err)
+		} else {
+			s.cfg.Logger.Printf("Не удалось отправить сообщение на %v (попытка %v), повтор в %v: %v", o.Phone, o.Attempts, o.NextAttempt.In(s.location).Format("15:04:05"), err)
+		}
+	}
+	return errors.Join(result, s.saveMessage(o))
+}
+
+// Функция проверяет, нужно ли отправлять сообщение сейчас
+// Пропущенные и отложенные до открытия окна доставки сообщения сохраняются, возвращается false.
+func (s *Syncer) prepareMessage(o *outbox) (bool, error) {
+	s.store.Lock()
+	defer s.store.Unlock()
+
+	// сообщение могли отправить, пока выдерживалось ограничение скорости
+	if current, ok := s.driver.getOutboxByIdDB(o.Id); !ok || current.State != OutboxPending {
+		return false, nil
+	}
+	// первая попытка могла опоздать (например, из-за ограничения скорости) настолько, что напоминание уже не нужно;
+	// повторы после неудачных попыток ограничены только RetryDeadline
+	send, reason := true, ""
+	if o.Attempts == 0 {
+		send, reason = s.missedDecision(o.scheduled(), time.Now())
+	}
+	if !send {
+		o.State = OutboxDropped
+		o.LastError = reason
+		s.cfg.Logger.Printf("Сообщение на %v, событие %v, время %v не отправлено: %v", o.Phone, o.Uid, o.DateTime.In(s.location).Format("2006-01-02 15:04"), reason)
+	} else if send, deferTo, reason := s.windowDecision(time.Now()); !send {
+		o.LastError = reason
+		if deferTo.IsZero() {
+			o.State = OutboxDropped
+			s.cfg.Logger.Printf("Сообщение на %v, событие %v, время %v не отправлено: %v", o.Phone, o.Uid, o.DateTime.In(s.location).Format("2006-01-02 15:04"), reason)
+		} else {
+			o.NextAttempt = deferTo
+			o.DeferredTo = deferTo
+		}
+	} else {
+		return true, nil
+	}
+	if err := s.driver.Driver.Upsert(*o); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	return false, nil
+}
+
+// Функция сохраняет исходящее сообщение в хранилище
+func (s *Syncer) saveMessage(o outbox) error {
+	s.store.Lock()
+	defer s.store.Unlock()
+
+	if err := s.driver.Driver.Upsert(o); err != nil {
+		return fmt.Errorf("%w: %v", ErrStorage, err)
+	}
+	return nil
+}
+
+// Функция записывает отчет о доставке в исходящее сообщение с идентификатором r.MessageID
+// Второе значение равно false, если сообщение не найдено
+func (s *Syncer) ApplyReceipt(r DeliveryReceipt) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.openDriver(); err != nil {
+		return false, err
+	}
+	s.store.Lock()
+	defer s.store.Unlock()
+	result, err := s.driver.getOutboxDB()
+	if err != nil {
+		return false, err
+	}
+	for _, o := range result {
+		if o.MessageId == "" || o.MessageId != r.MessageID {
+			continue
+		}
+		o.Receipt = r.State
+		if r.Err != "" && r.Err != "000" {
+			o.Receipt += " err:" + r.Err
+		}
+		if err := s.driver.Driver.Upsert(o); err != nil {
+			return false, fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,142 @@
+package caldavsms
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPruneOutbox(t *testing.T) {
+	s := newTestSyncer(t, func(cfg *Config) { cfg.OutboxRetention = 30 * 24 * time.Hour })
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-31 * 24 * time.Hour)
+	records := []outbox{
+		{Id: "old-sent", State: OutboxSent, DateTime: old, Occurrence: old},
+		{Id: "old-failed", State: OutboxFailed, DateTime: old, Occurrence: old},
+		{Id: "old-dropped", State: OutboxDropped, DateTime: old, Occurrence: old},
+		{Id: "old-pending", State: OutboxPending, DateTime: old, Occurrence: old},
+		{Id: "old-sending", State: OutboxSending, DateTime: old, Occurrence: old},
+		{Id: "recent-sent", State: OutboxSent, DateTime: now.Add(-time.Hour), Occurrence: now.Add(-time.Hour)},
+		// напоминание за несколько дней до события: хранится по времени события
+		{Id: "early-sent", State: OutboxSent, DateTime: old, Occurrence: now.Add(-24 * time.Hour)},
+		{Id: "deferred-sent", State: OutboxSent, DateTime: old, Occurrence: old, DeferredTo: now.Add(-24 * time.Hour)},
+	}
+	if err := s.driver.writeAllDB(records); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.pruneOutbox(now); err != nil {
+		t.Fatal(err)
+	}
+	os, err := s.driver.getOutboxDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, o := range os {
+		got = append(got, o.Id)
+	}
+	sort.Strings(got)
+	want := []string{"deferred-sent", "early-sent", "old-pending", "old-sending", "recent-sent"}
+	if len(got) != len(want) {
+		t.Fatalf("в журнале %v, ожидается %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("в журнале %v, ожидается %v", got, want)
+		}
+	}
+}
+
+func TestOutboxRetentionValidation(t *testing.T) {
+	cfg := Config{Location: "UTC", MinTime: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), FirstToken: "token", Calendars: []string{"cal"},
+		StorageName: t.TempDir(), Sender: &testSender{}, OutboxRetention: 7 * 24 * time.Hour}
+	if _, err := NewSyncer(cfg); err == nil {
+		t.Error("срок хранения не больше horizon + retrydeadline + missedgrace принят")
+	}
+}
+
+// Сообщение не отправляется на номер повторно ни при повторной постановке в очередь, ни после прерванной отправки,
+// а неудачные попытки повторяются с удваивающейся паузой до истечения RetryDeadline
+func TestOutboxAtMostOnce(t *testing.T) {
+	errGateway := errors.New("шлюз недоступен")
+	tests := []struct {
+		name string
+		errs []error
+		// подготовка хранилища перед отправкой, например запись прерванной отправки
+		prepare      func(t *testing.T, s *Syncer, m message)
+		rounds       int
+		wantSent     int
+		wantState    string
+		wantAttempts int
+	}{
+		{name: "повторная постановка в очередь", rounds: 3, wantSent: 1, wantState: OutboxSent, wantAttempts: 1},
+		{name: "повтор после ошибки", errs: []error{errGateway, errGateway}, rounds: 4, wantSent: 1, wantState: OutboxSent, wantAttempts: 3},
+		// повторы через 1, 2, 4 и 8 минут укладываются в срок 10 минут от запланированного времени, через 16 минут - нет
+		{name: "срок повторов истек", errs: []error{errGateway, errGateway, errGateway, errGateway, errGateway, errGateway}, rounds: 6,
+			wantSent: 0, wantState: OutboxFailed, wantAttempts: 5},
+		{name: "частичная доставка", errs: []error{ErrPartialDelivery}, rounds: 3, wantSent: 0, wantState: OutboxFailed, wantAttempts: 1},
+		{name: "прерванная отправка", rounds: 2, wantSent: 0, wantState: OutboxFailed, wantAttempts: 0,
+			prepare: func(t *testing.T, s *Syncer, m message) {
+				// процесс завершился после перевода сообщения в sending, до ответа шлюза
+				if err := s.enqueueMessages([]message{m}, m.DateTime); err != nil {
+					t.Fatal(err)
+				}
+				o, _ := s.driver.getOutboxByIdDB(m.outboxKey())
+				o.State = OutboxSending
+				if err := s.saveMessage(*o); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.recoverOutbox(); !errors.Is(err, ErrDeliveryFailed) {
+					t.Fatalf("ошибка %v, ожидается ErrDeliveryFailed", err)
+				}
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &testSender{errs: tt.errs}
+			s := newTestSyncer(t, func(cfg *Config) {
+				cfg.Sender = sender
+				cfg.RetryBackoff = time.Minute
+				cfg.RetryDeadline = 10 * time.Minute
+			})
+			m := message{Phone: "89001234567", Text: "Напоминание", Calendar: "cal", Uid: "e", UidTrigger: "a", DateTime: time.Now(), Occurrence: time.Now()}
+			if tt.prepare != nil {
+				tt.prepare(t, s, m)
+			}
+			for i := 0; i < tt.rounds; i++ {
+				// напоминание может быть рассчитано заново, например после изменения события
+				if err := s.enqueueMessages([]message{m}, time.Now()); err != nil {
+					t.Fatal(err)
+				}
+				start := time.Now()
+				// время отправки сдвинуто вперед, чтобы не ждать паузы между попытками
+				s.dispatch(context.Background(), start.Add(24*time.Hour))
+				os, err := s.driver.getOutboxDB()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(os) != 1 {
+					t.Fatalf("раунд %v: в очереди %v сообщений, ожидается 1", i+1, len(os))
+				}
+				if o := os[0]; o.State == OutboxPending {
+					backoff := s.retryBackoff(o.Attempts)
+					if o.NextAttempt.Before(start.Add(backoff)) || o.NextAttempt.After(time.Now().Add(backoff)) {
+						t.Errorf("раунд %v: следующая попытка через %v, ожидается %v", i+1, o.NextAttempt.Sub(start), backoff)
+					}
+				}
+			}
+			if got := sender.messages(); len(got) != tt.wantSent {
+				t.Errorf("отправлено %v сообщений, ожидается %v", len(got), tt.wantSent)
+			}
+			o, ok := s.driver.getOutboxByIdDB(m.outboxKey())
+			if !ok {
+				t.Fatal("сообщение не найдено в очереди")
+			}
+			if o.State != tt.wantState || o.Attempts != tt.wantAttempts {
+				t.Errorf("состояние %v, попыток %v; ожидается %v, %v", o.State, o.Attempts, tt.wantState, tt.wantAttempts)
+			}
+		})
+	}
+}
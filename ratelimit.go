@@ -0,0 +1,200 @@
+package caldavsms
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit - ограничение скорости отправки: Rate сообщений в секунду, до Burst сообщений подряд
+// Нулевой Rate - без ограничения
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitError - сообщение на номер не отправлено из-за ограничения на получателя
+// Отправку можно повторить через RetryAfter
+type RateLimitError struct {
+	Phone      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v: %v, повтор через %v", ErrRateLimited.Error(), e.Phone, e.RetryAfter.Round(time.Second))
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// Функция разбирает ограничение скорости вида "30/m": количество сообщений за секунду (s), минуту (m), час (h) или сутки (d)
+func ParseRate(v string) (float64, error) {
+	n, unit, ok := strings.Cut(strings.TrimSpace(v), "/")
+	count, err := strconv.ParseFloat(n, 64)
+	if !ok || err != nil || count < 0 {
+		return 0, fmt.Errorf("Некорректное ограничение скорости '%v', ожидается вид 30/m", v)
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[unit]
+	if per == 0 {
+		return 0, fmt.Errorf("Некорректная единица времени ограничения скорости '%v', допустимы s, m, h, d", v)
+	}
+	return count / per.Seconds(), nil
+}
+
+// Корзина токенов: пополняется со скоростью rate токенов в секунду до burst токенов
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l RateLimit, now time.Time) *tokenBucket {
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: l.Rate, burst: burst, tokens: burst, last: now}
+}
+
+// Функция пополняет корзину к моменту now
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// Функция возвращает время, через которое в корзине появится токен
+func (b *tokenBucket) delay(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Функция резервирует токен и возвращает время ожидания до него
+// Токен может быть зарезервирован в долг: следующие резервирования ждут дольше
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	d := b.delay(now)
+	b.tokens--
+	return d
+}
+
+// RateLimitedSender ограничивает скорость отправки через шлюз Sender
+// Общее ограничение шлюза выдерживается ожиданием, ограничение на получателя - ошибкой *RateLimitError,
+// после которой сообщение откладывается. Один RateLimitedSender, общий для нескольких учетных записей,
+// ограничивает их общую скорость.
+type RateLimitedSender struct {
+	Sender Sender
+
+	mu         sync.Mutex
+	limit      RateLimit
+	recipient  RateLimit
+	gateway    *tokenBucket
+	recipients map[string]*tokenBucket
+}
+
+// Функция возвращает шлюз с ограничением скорости limit для всех сообщений и recipient для сообщений на один номер
+func NewRateLimitedSender(sender Sender, limit, recipient RateLimit) *RateLimitedSender {
+	return &RateLimitedSender{Sender: sender, limit: limit, recipient: recipient, recipients: make(map[string]*tokenBucket)}
+}
+
+// Ключ контекста: ограничение уже выдержано вызовом Wait, значение - *RateLimitedSender, ограничение которого выдержано
+type rateReservedKey struct{}
+
+// Функция ждет возможности отправить сообщение на номер phone и резервирует ее
+// Если ограничение на получателя исчерпано, сразу возвращает *RateLimitError
+func (r *RateLimitedSender) Wait(ctx context.Context, phone string) error {
+	r.mu.Lock()
+	now := time.Now()
+	var rb *tokenBucket
+	if r.recipient.Rate > 0 {
+		if rb = r.recipients[phone]; rb == nil {
+			rb = newTokenBucket(r.recipient, now)
+			r.recipients[phone] = rb
+		}
+		if d := rb.delay(now); d > 0 {
+			r.mu.Unlock()
+			return &RateLimitError{Phone: phone, RetryAfter: d}
+		}
+	}
+	var wait time.Duration
+	if r.limit.Rate > 0 {
+		if r.gateway == nil {
+			r.gateway = newTokenBucket(r.limit, now)
+		}
+		wait = r.gateway.reserve(now)
+	}
+	if rb != nil {
+		rb.tokens--
+	}
+	r.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Функция отправляет сообщение, выдерживая ограничения скорости, если они не выдержаны вызовом Wait
+func (r *RateLimitedSender) Send(ctx context.Context, phone, text string) (*Delivery, error) {
+	if ctx.Value(rateReservedKey{}) != r {
+		if err := r.Wait(ctx, phone); err != nil {
+			return nil, err
+		}
+	}
+	return r.Sender.Send(ctx, phone, text)
+}
+
+// Функция возвращает количество одновременных отправок через шлюз Sender
+func (r *RateLimitedSender) Concurrency() int {
+	if c, ok := r.Sender.(concurrent); ok {
+		return c.Concurrency()
+	}
+	return 1
+}
+
+// Шлюз, ограничение скорости которого выдерживается до пометки сообщения как отправляемого
+type waiter interface {
+	Wait(ctx context.Context, phone string) error
+}
+
+// Функция ждет возможности отправки через шлюз sender и возвращает контекст для Send
+// Для шлюза, направляющего сообщения в другие шлюзы (ChannelSender), ожидает шлюз получателя
+func waitSender(ctx context.Context, sender Sender, phone string) (context.Context, error) {
+	for {
+		r, ok := sender.(router)
+		if !ok {
+			break
+		}
+		next, to, err := r.route(phone)
+		if err != nil {
+			// ошибка маршрута возвращается из Send
+			return ctx, nil
+		}
+		sender, phone = next, to
+	}
+	w, ok := sender.(waiter)
+	if !ok {
+		return ctx, nil
+	}
+	if err := w.Wait(ctx, phone); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, rateReservedKey{}, w), nil
+}
@@ -0,0 +1,86 @@
+package caldavsms
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SegmentPolicy - правило обработки SMS длиннее MaxSegments частей
+type SegmentPolicy int
+
+const (
+	// Обрезать текст до MaxSegments частей, последний символ заменяется на ">"
+	SegmentTruncate SegmentPolicy = iota
+	// Не отправлять сообщение
+	SegmentDrop
+)
+
+// Максимальное количество частей составного SMS
+const maxSMSSegments = 255
+
+func (p SegmentPolicy) String() string {
+	switch p {
+	case SegmentTruncate:
+		return "truncate"
+	case SegmentDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("SegmentPolicy(%d)", int(p))
+	}
+}
+
+// Функция разбирает правило обработки длинных SMS: "truncate" или "drop"
+func ParseSegmentPolicy(v string) (SegmentPolicy, error) {
+	for _, p := range []SegmentPolicy{SegmentTruncate, SegmentDrop} {
+		if p.String() == v {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Некорректное правило длинных сообщений '%v', допустимы truncate, drop", v)
+}
+
+// Функция возвращает количество частей SMS: 160 символов GSM 7-бит (символы таблицы расширения - за два)
+// или 70 символов UCS-2 в одном сообщении, 153 и 67 в каждой части составного
+func smsSegments(text string) int {
+	_, parts := splitMessage(text)
+	return len(parts)
+}
+
+// Функция обрезает текст до max частей SMS, заменяя окончание знаком ">"
+func truncateSMS(text string, max int) string {
+	if smsSegments(text) <= max {
+		return text
+	}
+	r := []rune(text)
+	// количество частей не убывает с длиной текста: ищем самый длинный подходящий префикс
+	n := sort.Search(len(r), func(i int) bool {
+		return smsSegments(string(r[:i+1])+">") > max
+	})
+	return string(r[:n]) + ">"
+}
+
+// Функция возвращает максимальное количество частей SMS
+func (s *Syncer) maxSegments() int {
+	if s.cfg.MaxSegments < 1 {
+		return 1
+	}
+	return s.cfg.MaxSegments
+}
+
+// Функция приводит текст SMS к MaxSegments частям по правилу SegmentPolicy и возвращает текст и количество частей
+func (s *Syncer) fitSMS(text string) (string, int) {
+	if s.cfg.SegmentPolicy == SegmentTruncate {
+		text = truncateSMS(text, s.maxSegments())
+	}
+	return text, smsSegments(text)
+}
+
+// Функция приводит тексты SMS к допустимой длине и записывает количество частей
+// Сообщения получателям других каналов не изменяются, количество частей у них 0
+func (s *Syncer) fitMessages(ms []message) {
+	for i := range ms {
+		if channel, _ := channelOf(ms[i].Phone); channel == ChannelSMS {
+			ms[i].Text, ms[i].Segments = s.fitSMS(ms[i].Text)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package caldavsms
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Шаблон запроса отправки SMS через GoIP-шлюз по умолчанию
+const goipDefaultTemplate = "/default/en_US/send.html?u={user}&p={password}&l={line}&n={phone}&m={text}"
+
+// Sender - интерфейс шлюза отправки SMS
+type Sender interface {
+	Send(ctx context.Context, phone, text string) (*Delivery, error)
+}
+
+// Delivery - результат передачи сообщения шлюзу
+type Delivery struct {
+	Status   int    `json:"status"`
+	Response string `json:"response"`
+	// Линия шлюза, через которую передано сообщение
+	Line string `json:"line"`
+	// Идентификатор сообщения у оператора, если шлюз его возвращает
+	MessageID string `json:"messageid"`
+}
+
+// MessageInfo - сведения о напоминании, по которому отправляется сообщение
+// Передаются шлюзу в контексте Send, см. MessageInfoFromContext
+type MessageInfo struct {
+	Calendar   string
+	Uid        string
+	UidTrigger string
+	Repeat     int
+	Occurrence time.Time
+	DateTime   time.Time
+}
+
+// Ключ контекста для MessageInfo
+type messageInfoKey struct{}
+
+// Функция возвращает контекст со сведениями о напоминании для шлюза
+func WithMessageInfo(ctx context.Context, info MessageInfo) context.Context {
+	return context.WithValue(ctx, messageInfoKey{}, info)
+}
+
+// Функция возвращает сведения о напоминании, переданные в контексте Send
+func MessageInfoFromContext(ctx context.Context) (MessageInfo, bool) {
+	info, ok := ctx.Value(messageInfoKey{}).(MessageInfo)
+	return info, ok
+}
+
+// GoIPSender отправляет SMS HTTP GET-запросом к GoIP-шлюзу
+type GoIPSender struct {
+	Host     string
+	User     string
+	Password string
+	Line     int
+	Template string
+	Client   *http.Client
+}
+
+// Функция возвращает GoIP-шлюз с шаблоном запроса по умолчанию
+func NewGoIPSender(host, user, password string, line int) *GoIPSender {
+	return &GoIPSender{Host: host, User: user, Password: password, Line: line, Template: goipDefaultTemplate}
+}
+
+// Функция формирует адрес запроса к шлюзу по шаблону
+// В шаблоне подставляются {user}, {password}, {line}, {phone} и {text}
+func (g *GoIPSender) url(phone, text string) string {
+	tmpl := g.Template
+	if tmpl == "" {
+		tmpl = goipDefaultTemplate
+	}
+	host := g.Host
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	r := strings.NewReplacer(
+		"{user}", url.QueryEscape(g.User),
+		"{password}", url.QueryEscape(g.Password),
+		"{line}", strconv.Itoa(g.Line),
+		"{phone}", url.QueryEscape(phone),
+		"{text}", url.QueryEscape(text),
+	)
+	return strings.TrimSuffix(host, "/") + r.Replace(tmpl)
+}
+
+func (g *GoIPSender) Send(ctx context.Context, phone, text string) (*Delivery, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.url(phone, text), nil)
+	if err != nil {
+		return nil, err
+	}
+	c := g.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	d := &Delivery{Status: resp.StatusCode, Response: string(body), Line: strconv.Itoa(g.Line)}
+	if resp.StatusCode != http.StatusOK {
+		return d, fmt.Errorf("Шлюз вернул статус %v", resp.Status)
+	}
+	return d, nil
+}
+
+// Функция выводит таблицу сообщений: телефон, текст, количество частей SMS, UID события, UID напоминания, запланированное время
+func writeMessagesTable(w io.Writer, loc *time.Location, ms []message) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHONE\tTEXT\tSEGMENTS\tUID\tTRIGGER UID\tSCHEDULED")
+	for _, m := range ms {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", m.Phone, m.Text, m.Segments, m.Uid, m.UidTrigger, m.DateTime.In(loc).Format("2006-01-02 15:04:05"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package caldavsms
+
+import (
+	"io"
+	"os"
+)
+
+// Функция открывает последовательный порт device
+// На платформах кроме Linux скорость baud не устанавливается: порт должен быть настроен заранее (stty)
+func OpenSerialPort(device string, baud int) (io.ReadWriteCloser, error) {
+	return os.OpenFile(device, os.O_RDWR, 0)
+}
@@ -0,0 +1,501 @@
+package caldavsms
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Команды SMPP 3.4
+const (
+	smppGenericNack         uint32 = 0x80000000
+	smppBindTransceiver     uint32 = 0x00000009
+	smppBindTransceiverResp uint32 = 0x80000009
+	smppSubmitSM            uint32 = 0x00000004
+	smppSubmitSMResp        uint32 = 0x80000004
+	smppDeliverSM           uint32 = 0x00000005
+	smppDeliverSMResp       uint32 = 0x80000005
+	smppUnbind              uint32 = 0x00000006
+	smppUnbindResp          uint32 = 0x80000006
+	smppEnquireLink         uint32 = 0x00000015
+	smppEnquireLinkResp     uint32 = 0x80000015
+)
+
+// Параметры SMPP 3.4
+const (
+	smppVersion          = 0x34
+	smppHeaderLen        = 16
+	smppMaxPDULen        = 64 * 1024
+	smppMaxShortMessage  = 254
+	smppStatusInvalidCmd = 0x00000003
+	// Кодировки data_coding: алфавит SMSC по умолчанию (GSM 7-бит) и UCS-2
+	smppCodingGSM7 = 0x00
+	smppCodingUCS2 = 0x08
+	// Необязательные параметры (TLV)
+	smppTagReceiptedMessageID = 0x001E
+	smppTagMessagePayload     = 0x0424
+	smppTagMessageState       = 0x0427
+)
+
+// Значения по умолчанию для SMPP-сессии
+const (
+	defaultSMPPEnquireLink = 30 * time.Second
+	defaultSMPPTimeout     = 10 * time.Second
+)
+
+// Состояния сообщения message_state из отчетов о доставке
+var smppMessageStates = map[byte]string{
+	1: "ENROUTE", 2: "DELIVRD", 3: "EXPIRED", 4: "DELETED", 5: "UNDELIV", 6: "ACCEPTD", 7: "UNKNOWN", 8: "REJECTD",
+}
+
+// SMPPSender отправляет SMS через SMPP 3.4-сервер оператора
+// Сессия (bind_transceiver) открывается при первой отправке, поддерживается запросами enquire_link
+// и открывается заново после обрыва соединения. Отчеты о доставке (deliver_sm) передаются OnReceipt.
+type SMPPSender struct {
+	// Адрес сервера host:port
+	Addr       string
+	SystemID   string
+	Password   string
+	SystemType string
+	// Адрес отправителя: номер телефона или буквенное имя
+	Source string
+	// Период запросов enquire_link и срок ожидания ответа сервера
+	EnquireLink time.Duration
+	Timeout     time.Duration
+	// Запрашивать отчеты о доставке
+	RegisteredDelivery bool
+	// Функция, которой передаются отчеты о доставке; вызывается из горутины чтения сессии
+	OnReceipt func(DeliveryReceipt)
+
+	mu      sync.Mutex
+	session *smppSession
+}
+
+// DeliveryReceipt - отчет о доставке сообщения, полученный от SMPP-сервера
+type DeliveryReceipt struct {
+	// Идентификатор сообщения, который сервер вернул при отправке (Delivery.MessageID)
+	MessageID string
+	Phone     string
+	// Состояние: DELIVRD, UNDELIV, EXPIRED, REJECTD и т. д.
+	State string
+	Err   string
+}
+
+// Функция возвращает SMPP-шлюз с параметрами сессии по умолчанию
+func NewSMPPSender(addr, systemID, password, source string) *SMPPSender {
+	return &SMPPSender{Addr: addr, SystemID: systemID, Password: password, Source: source,
+		EnquireLink: defaultSMPPEnquireLink, Timeout: defaultSMPPTimeout}
+}
+
+func (s *SMPPSender) Send(ctx context.Context, phone, text string) (*Delivery, error) {
+	body := s.submitBody(phone, text)
+	for attempt := 0; ; attempt++ {
+		session, err := s.open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := session.request(ctx, smppSubmitSM, body, s.timeout())
+		if errors.Is(err, errSMPPNotSent) && attempt == 0 {
+			// соединение оборвалось до передачи сообщения: открываем сессию заново
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		d := &Delivery{Status: int(resp.status), MessageID: cString(resp.body)}
+		if resp.status != 0 {
+			return d, fmt.Errorf("SMPP-сервер отклонил сообщение: статус 0x%08X", resp.status)
+		}
+		return d, nil
+	}
+}
+
+// Функция закрывает сессию (unbind)
+func (s *SMPPSender) Close() error {
+	s.mu.Lock()
+	session := s.session
+	s.session = nil
+	s.mu.Unlock()
+	if session == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout())
+	defer cancel()
+	_, err := session.request(ctx, smppUnbind, nil, s.timeout())
+	session.close(errSMPPClosed)
+	return err
+}
+
+func (s *SMPPSender) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return defaultSMPPTimeout
+}
+
+// Функция возвращает открытую сессию, при необходимости подключаясь и выполняя bind_transceiver
+func (s *SMPPSender) open(ctx context.Context) (*smppSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session != nil && !s.session.closed() {
+		return s.session, nil
+	}
+	s.session = nil
+	var d net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, s.timeout())
+	defer cancel()
+	conn, err := d.DialContext(dialCtx, "tcp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Не удалось подключиться к SMPP-серверу: %w", err)
+	}
+	session := &smppSession{conn: conn, pending: make(map[uint32]chan smppPDU), done: make(chan struct{}), onReceipt: s.OnReceipt}
+	go session.read()
+	var bind bytes.Buffer
+	writeCString(&bind, s.SystemID)
+	writeCString(&bind, s.Password)
+	writeCString(&bind, s.SystemType)
+	bind.Write([]byte{smppVersion, 0, 0})
+	writeCString(&bind, "")
+	resp, err := session.request(ctx, smppBindTransceiver, bind.Bytes(), s.timeout())
+	if err == nil && resp.status != 0 {
+		err = fmt.Errorf("SMPP-сервер отклонил авторизацию: статус 0x%08X", resp.status)
+	}
+	if err != nil {
+		session.close(err)
+		return nil, err
+	}
+	period := s.EnquireLink
+	if period <= 0 {
+		period = defaultSMPPEnquireLink
+	}
+	go session.keepalive(period, s.timeout())
+	s.session = session
+	return session, nil
+}
+
+// Функция формирует тело submit_sm
+// Текст в алфавите GSM передается с data_coding 0, иначе в UCS-2; длинный текст передается в message_payload
+func (s *SMPPSender) submitBody(phone, text string) []byte {
+	message, ok := encodeGSM7(text)
+	coding := byte(smppCodingGSM7)
+	if !ok {
+		message = encodeUCS2(text)
+		coding = smppCodingUCS2
+	}
+	var b bytes.Buffer
+	writeCString(&b, "")
+	srcTon, srcNpi, src := smppAddress(s.Source)
+	b.Write([]byte{srcTon, srcNpi})
+	writeCString(&b, src)
+	dstTon, dstNpi, dst := smppAddress(phone)
+	b.Write([]byte{dstTon, dstNpi})
+	writeCString(&b, dst)
+	// esm_class, protocol_id, priority_flag
+	b.Write([]byte{0, 0, 0})
+	writeCString(&b, "")
+	writeCString(&b, "")
+	var registered byte
+	if s.RegisteredDelivery {
+		registered = 1
+	}
+	// registered_delivery, replace_if_present_flag, data_coding, sm_default_msg_id
+	b.Write([]byte{registered, 0, coding, 0})
+	if len(message) <= smppMaxShortMessage {
+		b.WriteByte(byte(len(message)))
+		b.Write(message)
+	} else {
+		b.WriteByte(0)
+		writeTLV(&b, smppTagMessagePayload, message)
+	}
+	return b.Bytes()
+}
+
+// Функция возвращает TON, NPI и адрес: международный номер (+7...), национальный номер или буквенное имя
+func smppAddress(addr string) (byte, byte, string) {
+	if addr == "" {
+		return 0, 0, ""
+	}
+	if strings.HasPrefix(addr, "+") {
+		return 1, 1, addr[1:]
+	}
+	if strings.Trim(addr, "0123456789") == "" {
+		return 0, 1, addr
+	}
+	return 5, 0, addr
+}
+
+var (
+	errSMPPNotSent = errors.New("Запрос не передан SMPP-серверу")
+	errSMPPClosed  = errors.New("SMPP-сессия закрыта")
+)
+
+// Пакет SMPP
+type smppPDU struct {
+	id     uint32
+	status uint32
+	seq    uint32
+	body   []byte
+}
+
+// SMPP-сессия: соединение, ожидающие ответа запросы и горутины чтения и enquire_link
+type smppSession struct {
+	conn      net.Conn
+	seq       atomic.Uint32
+	wmu       sync.Mutex
+	mu        sync.Mutex
+	pending   map[uint32]chan smppPDU
+	done      chan struct{}
+	once      sync.Once
+	err       error
+	onReceipt func(DeliveryReceipt)
+}
+
+func (c *smppSession) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Функция закрывает соединение, ожидающие запросы завершаются ошибкой err
+func (c *smppSession) close(err error) {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *smppSession) write(p smppPDU) error {
+	b := make([]byte, smppHeaderLen, smppHeaderLen+len(p.body))
+	binary.BigEndian.PutUint32(b[0:], uint32(smppHeaderLen+len(p.body)))
+	binary.BigEndian.PutUint32(b[4:], p.id)
+	binary.BigEndian.PutUint32(b[8:], p.status)
+	binary.BigEndian.PutUint32(b[12:], p.seq)
+	b = append(b, p.body...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(defaultSMPPTimeout))
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// Функция отправляет запрос и ждет ответа с тем же sequence_number
+// Если запрос не удалось записать в соединение, возвращает errSMPPNotSent
+func (c *smppSession) request(ctx context.Context, id uint32, body []byte, timeout time.Duration) (smppPDU, error) {
+	seq := c.seq.Add(1)
+	ch := make(chan smppPDU, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return smppPDU{}, fmt.Errorf("%w: %v", errSMPPNotSent, c.err)
+	}
+	c.pending[seq] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, seq)
+		c.mu.Unlock()
+	}()
+	if err := c.write(smppPDU{id: id, seq: seq, body: body}); err != nil {
+		c.close(err)
+		return smppPDU{}, fmt.Errorf("%w: %v", errSMPPNotSent, err)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-ch:
+		if resp.id == smppGenericNack {
+			return resp, fmt.Errorf("SMPP-сервер не принял запрос: статус 0x%08X", resp.status)
+		}
+		return resp, nil
+	case <-c.done:
+		return smppPDU{}, fmt.Errorf("SMPP-соединение разорвано до ответа: %v", c.err)
+	case <-timer.C:
+		c.close(fmt.Errorf("нет ответа SMPP-сервера"))
+		return smppPDU{}, fmt.Errorf("SMPP-сервер не ответил за %v", timeout)
+	case <-ctx.Done():
+		return smppPDU{}, ctx.Err()
+	}
+}
+
+// Функция читает пакеты сервера: передает ответы ожидающим запросам, отвечает на enquire_link, deliver_sm и unbind
+func (c *smppSession) read() {
+	for {
+		p, err := readPDU(c.conn)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		if p.id&smppGenericNack != 0 {
+			c.mu.Lock()
+			ch := c.pending[p.seq]
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- p
+			}
+			continue
+		}
+		switch p.id {
+		case smppEnquireLink:
+			err = c.write(smppPDU{id: smppEnquireLinkResp, seq: p.seq})
+		case smppDeliverSM:
+			err = c.write(smppPDU{id: smppDeliverSMResp, seq: p.seq, body: []byte{0}})
+			if r, ok := parseDeliveryReceipt(p.body); ok && c.onReceipt != nil {
+				c.onReceipt(r)
+			}
+		case smppUnbind:
+			c.write(smppPDU{id: smppUnbindResp, seq: p.seq})
+			c.close(errors.New("SMPP-сервер закрыл сессию"))
+			return
+		default:
+			err = c.write(smppPDU{id: smppGenericNack, status: smppStatusInvalidCmd, seq: p.seq})
+		}
+		if err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+// Функция периодически отправляет enquire_link; если сервер не отвечает, соединение закрывается
+func (c *smppSession) keepalive(period, timeout time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if _, err := c.request(context.Background(), smppEnquireLink, nil, timeout); err != nil {
+				c.close(err)
+				return
+			}
+		}
+	}
+}
+
+// Функция читает пакет SMPP
+func readPDU(r io.Reader) (smppPDU, error) {
+	var header [smppHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return smppPDU{}, err
+	}
+	length := binary.BigEndian.Uint32(header[0:])
+	if length < smppHeaderLen || length > smppMaxPDULen {
+		return smppPDU{}, fmt.Errorf("Некорректная длина SMPP-пакета %v", length)
+	}
+	p := smppPDU{
+		id:     binary.BigEndian.Uint32(header[4:]),
+		status: binary.BigEndian.Uint32(header[8:]),
+		seq:    binary.BigEndian.Uint32(header[12:]),
+		body:   make([]byte, length-smppHeaderLen),
+	}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return smppPDU{}, err
+	}
+	return p, nil
+}
+
+// Функция разбирает deliver_sm с отчетом о доставке (esm_class 0x04)
+// Идентификатор и состояние берутся из TLV receipted_message_id и message_state, иначе из текста "id:... stat:... err:..."
+func parseDeliveryReceipt(body []byte) (DeliveryReceipt, bool) {
+	r := bytes.NewReader(body)
+	var receipt DeliveryReceipt
+	readCString(r) // service_type
+	r.ReadByte()   // source_addr_ton
+	r.ReadByte()   // source_addr_npi
+	receipt.Phone = readCString(r)
+	r.ReadByte() // dest_addr_ton
+	r.ReadByte() // dest_addr_npi
+	readCString(r)
+	esmClass, err := r.ReadByte()
+	if err != nil || esmClass&0x3C != 0x04 {
+		return receipt, false
+	}
+	// protocol_id, priority_flag
+	r.ReadByte()
+	r.ReadByte()
+	readCString(r) // schedule_delivery_time
+	readCString(r) // validity_period
+	// registered_delivery, replace_if_present_flag, data_coding, sm_default_msg_id
+	r.Seek(4, io.SeekCurrent)
+	length, err := r.ReadByte()
+	if err != nil {
+		return receipt, false
+	}
+	text := make([]byte, length)
+	if _, err := io.ReadFull(r, text); err != nil {
+		return receipt, false
+	}
+	for _, field := range strings.Fields(string(text)) {
+		key, value, _ := strings.Cut(field, ":")
+		switch strings.ToLower(key) {
+		case "id":
+			receipt.MessageID = value
+		case "stat":
+			receipt.State = value
+		case "err":
+			receipt.Err = value
+		}
+	}
+	for r.Len() >= 4 {
+		var tlv [4]byte
+		io.ReadFull(r, tlv[:])
+		value := make([]byte, binary.BigEndian.Uint16(tlv[2:]))
+		if _, err := io.ReadFull(r, value); err != nil {
+			break
+		}
+		switch binary.BigEndian.Uint16(tlv[:]) {
+		case smppTagReceiptedMessageID:
+			receipt.MessageID = cString(value)
+		case smppTagMessageState:
+			if len(value) == 1 && smppMessageStates[value[0]] != "" {
+				receipt.State = smppMessageStates[value[0]]
+			}
+		}
+	}
+	return receipt, receipt.MessageID != ""
+}
+
+func writeCString(b *bytes.Buffer, s string) {
+	b.WriteString(s)
+	b.WriteByte(0)
+}
+
+func writeTLV(b *bytes.Buffer, tag uint16, value []byte) {
+	binary.Write(b, binary.BigEndian, tag)
+	binary.Write(b, binary.BigEndian, uint16(len(value)))
+	b.Write(value)
+}
+
+// Функция возвращает строку до нулевого байта
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+func readCString(r *bytes.Reader) string {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil || c == 0 {
+			return string(b)
+		}
+		b = append(b, c)
+	}
+}
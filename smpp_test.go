@@ -0,0 +1,356 @@
+package caldavsms
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Заглушка SMPP-сервера: принимает bind_transceiver, submit_sm, enquire_link и unbind,
+// запоминает полученные пакеты и позволяет отправить клиенту deliver_sm или разорвать соединения
+type smppStub struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	binds    []smppPDU
+	submits  []smppPDU
+	enquires int
+	// ответы клиента на запросы сервера (deliver_sm_resp, enquire_link_resp)
+	responses chan smppPDU
+}
+
+func newSMPPStub(t *testing.T) *smppStub {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smppStub{t: t, ln: ln, responses: make(chan smppPDU, 16)}
+	go s.accept()
+	t.Cleanup(func() {
+		ln.Close()
+		s.drop()
+	})
+	return s
+}
+
+func (s *smppStub) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *smppStub) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+func (s *smppStub) serve(conn net.Conn) {
+	for {
+		p, err := readPDU(conn)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		var resp smppPDU
+		switch p.id {
+		case smppBindTransceiver:
+			s.binds = append(s.binds, p)
+			resp = smppPDU{id: smppBindTransceiverResp, seq: p.seq, body: []byte("stub\x00")}
+		case smppSubmitSM:
+			s.submits = append(s.submits, p)
+			resp = smppPDU{id: smppSubmitSMResp, seq: p.seq, body: []byte(fmt.Sprintf("msg-%v\x00", len(s.submits)))}
+		case smppEnquireLink:
+			s.enquires++
+			resp = smppPDU{id: smppEnquireLinkResp, seq: p.seq}
+		case smppUnbind:
+			resp = smppPDU{id: smppUnbindResp, seq: p.seq}
+		default:
+			s.mu.Unlock()
+			s.responses <- p
+			continue
+		}
+		s.mu.Unlock()
+		if err := writeStubPDU(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// Функция отправляет пакет клиенту по последнему соединению
+func (s *smppStub) send(p smppPDU) {
+	s.mu.Lock()
+	conn := s.conns[len(s.conns)-1]
+	s.mu.Unlock()
+	if err := writeStubPDU(conn, p); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// Функция разрывает все соединения
+func (s *smppStub) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *smppStub) counts() (binds, submits, enquires int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.binds), len(s.submits), s.enquires
+}
+
+func (s *smppStub) submit(i int) smppPDU {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.submits[i]
+}
+
+func writeStubPDU(w io.Writer, p smppPDU) error {
+	b := make([]byte, smppHeaderLen, smppHeaderLen+len(p.body))
+	binary.BigEndian.PutUint32(b[0:], uint32(smppHeaderLen+len(p.body)))
+	binary.BigEndian.PutUint32(b[4:], p.id)
+	binary.BigEndian.PutUint32(b[8:], p.status)
+	binary.BigEndian.PutUint32(b[12:], p.seq)
+	_, err := w.Write(append(b, p.body...))
+	return err
+}
+
+// Поля submit_sm, которые проверяют тесты
+type smppSubmit struct {
+	dst     string
+	coding  byte
+	message []byte
+	payload []byte
+}
+
+func parseSubmit(t *testing.T, body []byte) smppSubmit {
+	t.Helper()
+	r := bytes.NewReader(body)
+	var s smppSubmit
+	readCString(r) // service_type
+	r.Seek(2, io.SeekCurrent)
+	readCString(r) // source_addr
+	r.Seek(2, io.SeekCurrent)
+	s.dst = readCString(r)
+	r.Seek(3, io.SeekCurrent) // esm_class, protocol_id, priority_flag
+	readCString(r)            // schedule_delivery_time
+	readCString(r)            // validity_period
+	r.Seek(2, io.SeekCurrent) // registered_delivery, replace_if_present_flag
+	s.coding, _ = r.ReadByte()
+	r.ReadByte() // sm_default_msg_id
+	length, err := r.ReadByte()
+	if err != nil {
+		t.Fatalf("submit_sm обрезан: %v", err)
+	}
+	s.message = make([]byte, length)
+	io.ReadFull(r, s.message)
+	for r.Len() >= 4 {
+		var tlv [4]byte
+		io.ReadFull(r, tlv[:])
+		value := make([]byte, binary.BigEndian.Uint16(tlv[2:]))
+		io.ReadFull(r, value)
+		if binary.BigEndian.Uint16(tlv[:]) == smppTagMessagePayload {
+			s.payload = value
+		}
+	}
+	return s
+}
+
+// Функция ждет выполнения условия cond
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("не дождались: %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSMPPSenderBindAndSubmit(t *testing.T) {
+	stub := newSMPPStub(t)
+	s := NewSMPPSender(stub.addr(), "user", "secret", "Clinic")
+	defer s.Close()
+
+	long := strings.Repeat("Напоминание о приеме. ", 10)
+	tests := []struct {
+		text    string
+		coding  byte
+		message []byte
+		payload []byte
+	}{
+		{"Hello {1}", smppCodingGSM7, []byte("Hello \x1b\x281\x1b\x29"), nil},
+		{"Привет", smppCodingUCS2, encodeUCS2("Привет"), nil},
+		{long, smppCodingUCS2, []byte{}, encodeUCS2(long)},
+	}
+	for i, tt := range tests {
+		d, err := s.Send(context.Background(), "+79001234567", tt.text)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.text, err)
+		}
+		if want := fmt.Sprintf("msg-%v", i+1); d.MessageID != want {
+			t.Errorf("%q: MessageID = %q, ожидается %q", tt.text, d.MessageID, want)
+		}
+		sub := parseSubmit(t, stub.submit(i).body)
+		if sub.dst != "79001234567" {
+			t.Errorf("%q: destination_addr = %q", tt.text, sub.dst)
+		}
+		if sub.coding != tt.coding {
+			t.Errorf("%q: data_coding = %#x, ожидается %#x", tt.text, sub.coding, tt.coding)
+		}
+		if !bytes.Equal(sub.message, tt.message) {
+			t.Errorf("%q: short_message = % x, ожидается % x", tt.text, sub.message, tt.message)
+		}
+		if !bytes.Equal(sub.payload, tt.payload) {
+			t.Errorf("%q: message_payload = % x, ожидается % x", tt.text, sub.payload, tt.payload)
+		}
+	}
+
+	binds, _, _ := stub.counts()
+	if binds != 1 {
+		t.Fatalf("bind_transceiver выполнен %v раз, ожидается 1", binds)
+	}
+	r := bytes.NewReader(stub.binds[0].body)
+	if id, password := readCString(r), readCString(r); id != "user" || password != "secret" {
+		t.Errorf("bind_transceiver: system_id %q, password %q", id, password)
+	}
+	readCString(r) // system_type
+	if version, _ := r.ReadByte(); version != smppVersion {
+		t.Errorf("bind_transceiver: interface_version %#x", version)
+	}
+}
+
+func TestSMPPSenderEnquireLink(t *testing.T) {
+	stub := newSMPPStub(t)
+	s := NewSMPPSender(stub.addr(), "user", "secret", "")
+	s.EnquireLink = 20 * time.Millisecond
+	defer s.Close()
+
+	if _, err := s.Send(context.Background(), "89001234567", "test"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "enquire_link", func() bool {
+		_, _, enquires := stub.counts()
+		return enquires >= 2
+	})
+	// на enquire_link сервера клиент отвечает enquire_link_resp
+	stub.send(smppPDU{id: smppEnquireLink, seq: 100})
+	select {
+	case p := <-stub.responses:
+		if p.id != smppEnquireLinkResp || p.seq != 100 {
+			t.Errorf("ответ на enquire_link: команда %#x, sequence %v", p.id, p.seq)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("нет ответа на enquire_link")
+	}
+}
+
+func TestSMPPSenderReconnect(t *testing.T) {
+	stub := newSMPPStub(t)
+	s := NewSMPPSender(stub.addr(), "user", "secret", "")
+	defer s.Close()
+
+	if _, err := s.Send(context.Background(), "89001234567", "first"); err != nil {
+		t.Fatal(err)
+	}
+	stub.drop()
+	waitFor(t, "закрытие сессии", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.session.closed()
+	})
+	if _, err := s.Send(context.Background(), "89001234567", "second"); err != nil {
+		t.Fatalf("отправка после обрыва соединения: %v", err)
+	}
+	if binds, submits, _ := stub.counts(); binds != 2 || submits != 2 {
+		t.Errorf("bind_transceiver %v, submit_sm %v, ожидается 2 и 2", binds, submits)
+	}
+}
+
+func TestSMPPSenderReceipt(t *testing.T) {
+	stub := newSMPPStub(t)
+	s := NewSMPPSender(stub.addr(), "user", "secret", "")
+	s.RegisteredDelivery = true
+	receipts := make(chan DeliveryReceipt, 2)
+	s.OnReceipt = func(r DeliveryReceipt) { receipts <- r }
+	defer s.Close()
+
+	d, err := s.Send(context.Background(), "89001234567", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub := stub.submit(0).body; !bytes.Contains(sub, []byte{1, 0, smppCodingGSM7, 0}) {
+		t.Errorf("submit_sm без registered_delivery: % x", sub)
+	}
+
+	deliver := func(text string, tlvs ...[]byte) []byte {
+		var b bytes.Buffer
+		writeCString(&b, "")
+		b.Write([]byte{1, 1})
+		writeCString(&b, "79001234567")
+		b.Write([]byte{0, 0})
+		writeCString(&b, "")
+		b.Write([]byte{0x04, 0, 0}) // esm_class: отчет о доставке
+		writeCString(&b, "")
+		writeCString(&b, "")
+		b.Write([]byte{0, 0, 0, 0})
+		b.WriteByte(byte(len(text)))
+		b.WriteString(text)
+		for _, tlv := range tlvs {
+			b.Write(tlv)
+		}
+		return b.Bytes()
+	}
+	tlv := func(tag uint16, value []byte) []byte {
+		var b bytes.Buffer
+		writeTLV(&b, tag, value)
+		return b.Bytes()
+	}
+	tests := []struct {
+		body []byte
+		want DeliveryReceipt
+	}{
+		{deliver("id:" + d.MessageID + " sub:001 dlvrd:001 submit date:2501011200 done date:2501011201 stat:DELIVRD err:000 text:"),
+			DeliveryReceipt{MessageID: d.MessageID, Phone: "79001234567", State: "DELIVRD", Err: "000"}},
+		{deliver("", tlv(smppTagReceiptedMessageID, []byte(d.MessageID+"\x00")), tlv(smppTagMessageState, []byte{5})),
+			DeliveryReceipt{MessageID: d.MessageID, Phone: "79001234567", State: "UNDELIV"}},
+	}
+	for i, tt := range tests {
+		seq := uint32(200 + i)
+		stub.send(smppPDU{id: smppDeliverSM, seq: seq, body: tt.body})
+		select {
+		case r := <-receipts:
+			if r != tt.want {
+				t.Errorf("отчет %v: %+v, ожидается %+v", i, r, tt.want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("отчет %v не передан OnReceipt", i)
+		}
+		select {
+		case p := <-stub.responses:
+			if p.id != smppDeliverSMResp || p.seq != seq {
+				t.Errorf("ответ на deliver_sm: команда %#x, sequence %v", p.id, p.seq)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("нет ответа на deliver_sm")
+		}
+	}
+}
@@ -0,0 +1,602 @@
+package caldavsms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Минимальная пауза между циклами синхронизации в режиме демона
+	minRunPause = time.Second
+	// Максимальная пауза между проверками очереди сообщений в режиме демона
+	dispatchIdle = 10 * time.Minute
+	// Период планирования напоминаний по умолчанию
+	defaultHorizon = 7 * 24 * time.Hour
+)
+
+// Config - параметры синхронизации одного календаря
+type Config struct {
+	// Имя пользователя и пароль CalDAV-сервера (digest-авторизация)
+	Username string
+	Password string
+	// Адрес CalDAV-сервиса, например "http://host:8080/baikal/html/dav.php"
+	URI string
+	// Отображаемые имена календарей, AllCalendars - все календари пользователя
+	Calendars []string
+	// Локализация вида "Europe/Moscow", используется для событий без TZID
+	Location string
+	// Каталог файлового хранилища
+	StorageName string
+	// Первоначальный токен синхронизации (для архивной загрузки)
+	FirstToken string
+	// Минимальное время (для того, чтобы из-за сбоя времени и отсутствия файла базы данных не сыпались старые СМС)
+	MinTime time.Time
+	// Шлюз отправки SMS
+	Sender Sender
+	// Журнал ошибок режима демона, по умолчанию log.Default()
+	Logger *log.Logger
+	// Режим проверки: календарь синхронизируется и напоминания рассчитываются, но сообщения не отправляются,
+	// а выводятся таблицей в DryRunOutput (по умолчанию os.Stdout). Хранилище не изменяется:
+	// изменения календаря загружаются во временную копию, токен синхронизации не сохраняется.
+	DryRun       bool
+	DryRunOutput io.Writer
+	// Пауза перед первой повторной отправкой, удваивается с каждой попыткой (по умолчанию 1 минута)
+	RetryBackoff time.Duration
+	// Срок повторных отправок от запланированного времени сообщения (по умолчанию 2 часа)
+	RetryDeadline time.Duration
+	// Правило обработки пропущенных напоминаний (по умолчанию MissedSendAll)
+	MissedPolicy MissedPolicy
+	// Опоздание, после которого напоминание считается пропущенным (по умолчанию 5 минут)
+	MissedTolerance time.Duration
+	// Допустимое опоздание для правила MissedSendWithinGrace (по умолчанию 1 час)
+	MissedGrace time.Duration
+	// Период вперед, на который планируются напоминания повторяющихся событий (по умолчанию 7 дней)
+	// Ближайшее напоминание каждого VALARM планируется независимо от периода
+	Horizon time.Duration
+	// Срок хранения отправленных, неотправленных и пропущенных сообщений от времени напоминания (по умолчанию 30 дней)
+	// Должен быть больше Horizon + RetryDeadline + MissedGrace: пока запись хранится, напоминание не отправляется повторно
+	OutboxRetention time.Duration
+	// Значения ACTION напоминаний, по которым отправляются сообщения, например DISPLAY, EMAIL, X-SMS
+	// Пустой список - все напоминания
+	Actions []string
+	// Время суток, на которое переносятся напоминания событий на весь день, кратные суткам ("PT0S", "-P1D"),
+	// nil - 9:00; полночь задается нулевой длительностью
+	AllDayTime *time.Duration
+	// Тихие часы [QuietFrom, QuietTo) для напоминаний событий на весь день: время суток, интервал может переходить через полночь
+	// Попавшие в них напоминания переносятся по правилу QuietPolicy (по умолчанию QuietKeep - не переносятся)
+	QuietFrom   time.Duration
+	QuietTo     time.Duration
+	QuietPolicy QuietPolicy
+	// Окна доставки сообщений (пустой список - в любое время) и праздничные дни, в которые сообщения не отправляются
+	// Сообщения вне окон откладываются или не отправляются по правилу WindowPolicy (по умолчанию WindowDefer)
+	DeliveryWindows []DeliveryWindow
+	Holidays        []time.Time
+	WindowPolicy    WindowPolicy
+	// Максимальное количество частей SMS (по умолчанию 1, не больше 255)
+	// Более длинные сообщения обрезаются или не отправляются по правилу SegmentPolicy (по умолчанию SegmentTruncate)
+	MaxSegments   int
+	SegmentPolicy SegmentPolicy
+}
+
+// Syncer выполняет синхронизацию календаря и рассылку напоминаний по заданной конфигурации
+// Несколько Syncer с разными хранилищами могут работать одновременно
+// Клиент CalDAV, хранилище и пути к календарям создаются при первой синхронизации и переиспользуются
+type Syncer struct {
+	cfg      Config
+	location *time.Location
+
+	mu            sync.Mutex
+	client        *client
+	driver        *driver
+	calendarpaths []string
+	// Хранилище заблокировано на время работы демона, сообщения отправляются отдельно от синхронизации:
+	// после постановки сообщений в очередь синхронизация будит отправку через wake
+	held bool
+	wake chan struct{}
+	// Монопольный доступ к хранилищу: simdb не поддерживает одновременную работу,
+	// а в режиме демона отправка идет параллельно синхронизации. Захватывается после mu.
+	store sync.Mutex
+}
+
+// Функция проверяет конфигурацию и возвращает новый Syncer
+func NewSyncer(cfg Config) (*Syncer, error) {
+	loc, err := time.LoadLocation(cfg.Location)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTime, err)
+	}
+	if cfg.MinTime.IsZero() {
+		return nil, fmt.Errorf("%w: не задан параметр mintime", ErrClockBeforeMintime)
+	}
+	if cfg.FirstToken == "" {
+		return nil, fmt.Errorf("Не задан первоначальный токен синхронизации")
+	}
+	if len(cfg.Calendars) == 0 {
+		return nil, fmt.Errorf("Не заданы календари")
+	}
+	if cfg.StorageName == "" {
+		return nil, fmt.Errorf("Не задан каталог хранилища")
+	}
+	if cfg.Sender == nil {
+		return nil, fmt.Errorf("Не задан шлюз отправки SMS")
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	if cfg.DryRunOutput == nil {
+		cfg.DryRunOutput = os.Stdout
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = defaultRetryBackoff
+	}
+	if cfg.RetryDeadline <= 0 {
+		cfg.RetryDeadline = defaultRetryDeadline
+	}
+	if cfg.MissedTolerance <= 0 {
+		cfg.MissedTolerance = defaultMissedTolerance
+	}
+	if cfg.MissedGrace <= 0 {
+		cfg.MissedGrace = defaultMissedGrace
+	}
+	if cfg.Horizon <= 0 {
+		cfg.Horizon = defaultHorizon
+	}
+	if cfg.OutboxRetention <= 0 {
+		cfg.OutboxRetention = defaultOutboxRetention
+	}
+	if window := cfg.Horizon + cfg.RetryDeadline + cfg.MissedGrace; cfg.OutboxRetention <= window {
+		return nil, fmt.Errorf("Срок хранения журнала отправки должен быть больше %v (horizon + retrydeadline + missedgrace)", window)
+	}
+	if cfg.AllDayTime != nil {
+		// значение копируется, чтобы изменение переменной вызывающего не влияло на Syncer
+		allDayTime := *cfg.AllDayTime
+		cfg.AllDayTime = &allDayTime
+	}
+	if cfg.AllDayTime != nil && (*cfg.AllDayTime < 0 || *cfg.AllDayTime >= 24*time.Hour) || cfg.QuietFrom < 0 || cfg.QuietFrom >= 24*time.Hour || cfg.QuietTo < 0 || cfg.QuietTo >= 24*time.Hour {
+		return nil, fmt.Errorf("Время суток напоминаний и тихих часов должно быть меньше 24 часов")
+	}
+	if err := validateWindows(cfg.DeliveryWindows); err != nil {
+		return nil, err
+	}
+	if cfg.MaxSegments < 0 || cfg.MaxSegments > maxSMSSegments {
+		return nil, fmt.Errorf("Количество частей SMS должно быть от 1 до %v", maxSMSSegments)
+	}
+	return &Syncer{cfg: cfg, location: loc}, nil
+}
+
+// Функция открывает хранилище, если это еще не сделано
+func (s *Syncer) openDriver() error {
+	if s.driver == nil {
+		driver, err := initDriver(s.cfg.StorageName)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		s.driver = driver
+	}
+	return nil
+}
+
+// Функция создает клиента CalDAV и находит пути к календарям, если это еще не сделано
+func (s *Syncer) openCalendars(ctx context.Context) error {
+	if s.client == nil {
+		client, err := newClient(s.cfg.Username, s.cfg.Password, s.cfg.URI)
+		if err != nil {
+			return syncError("подключение к CalDAV", err)
+		}
+		s.client = client
+	}
+	if s.calendarpaths == nil {
+		calendarpaths, err := s.client.getCalendarPaths(ctx, s.cfg.Calendars)
+		if err != nil {
+			return syncError("поиск календаря", err)
+		}
+		s.calendarpaths = calendarpaths
+	}
+	return nil
+}
+
+// Функция выполняет процесс синхронизации всех календарей и рассылку сообщений
+// Ошибка одного календаря не прерывает синхронизацию остальных, сообщения из хранилища рассылаются в любом случае,
+// в том числе при недоступности сервера CalDAV.
+// В случае ошибки возвращает *SyncError (или объединение нескольких *SyncError через errors.Join),
+// причину можно проверить через errors.Is (ErrAuth, ErrCalendarNotFound и т.д.)
+func (s *Syncer) Sync(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	currenttime, err := s.getCurrentTime()
+	if err != nil {
+		return syncError("текущее время", err)
+	}
+	if err := s.openDriver(); err != nil {
+		return syncError("инициализация хранилища", err)
+	}
+	driver := s.driver
+	if !s.held {
+		unlock, err := lockStorage(s.cfg.StorageName)
+		if err != nil {
+			return syncError("блокировка хранилища", err)
+		}
+		defer unlock()
+	}
+	if s.cfg.DryRun {
+		return s.dryRun(ctx, currenttime)
+	}
+	var errs []error
+	if !s.held {
+		s.store.Lock()
+		err = s.recoverOutbox()
+		s.store.Unlock()
+		if err != nil {
+			errs = append(errs, syncError("проверка очереди сообщений", err))
+		}
+	}
+	// без сервера CalDAV рассылаем напоминания, уже рассчитанные в хранилище
+	synced, errs := s.syncCalendars(ctx, errs)
+	if err := s.enqueueDue(currenttime); err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	s.store.Lock()
+	err = s.pruneOutbox(currenttime)
+	s.store.Unlock()
+	if err != nil {
+		errs = append(errs, syncError("очистка журнала отправки", err))
+	}
+	// отправляем сообщения из очереди, в том числе повторно; в режиме демона их отправляет dispatchLoop
+	if s.wake != nil {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	} else if err := s.dispatch(ctx, currenttime); err != nil {
+		errs = append(errs, syncError("отправка сообщений", err))
+	}
+	s.store.Lock()
+	defer s.store.Unlock()
+	for _, p := range synced {
+		if err := driver.writePropsDB(p.Id, currenttime, p.Token); err != nil {
+			errs = append(errs, syncError("запись параметров синхронизации "+p.Id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Функция загружает изменения всех календарей в хранилище и возвращает новые токены синхронизированных календарей
+// Ошибки календарей добавляются к errs и не прерывают синхронизацию остальных
+func (s *Syncer) syncCalendars(ctx context.Context, errs []error) ([]props, []error) {
+	if err := s.openCalendars(ctx); err != nil {
+		return nil, append(errs, err)
+	}
+	var synced []props
+	for _, calendarpath := range s.calendarpaths {
+		token, err := s.syncCalendar(ctx, calendarpath)
+		if err != nil {
+			// календарь могли удалить или переименовать, при следующей синхронизации ищем пути заново
+			s.calendarpaths = nil
+			errs = append(errs, err)
+			continue
+		}
+		synced = append(synced, props{Id: calendarpath, Token: token})
+	}
+	return synced, errs
+}
+
+// Функция выполняет синхронизацию в режиме проверки: изменения календарей загружаются во временную копию хранилища,
+// наступившие по ней сообщения выводятся таблицей. Хранилище не изменяется: напоминания не переносятся,
+// очередь не проверяется и не отправляется, токены не сохраняются, чтобы следующая обычная синхронизация отправила сообщения.
+func (s *Syncer) dryRun(ctx context.Context, currenttime time.Time) error {
+	dir, err := os.MkdirTemp("", "caldavsms-dryrun-")
+	if err != nil {
+		return syncError("копирование хранилища", fmt.Errorf("%w: %v", ErrStorage, err))
+	}
+	defer os.RemoveAll(dir)
+	s.store.Lock()
+	err = copyStorage(s.cfg.StorageName, dir)
+	s.store.Unlock()
+	if err != nil {
+		return syncError("копирование хранилища", fmt.Errorf("%w: %v", ErrStorage, err))
+	}
+	driver, err := initDriver(dir)
+	if err != nil {
+		return syncError("копирование хранилища", fmt.Errorf("%w: %v", ErrStorage, err))
+	}
+	storage := s.driver
+	s.driver = driver
+	defer func() { s.driver = storage }()
+
+	_, errs := s.syncCalendars(ctx, nil)
+	msForSend, err := driver.getMessagesBefore(currenttime)
+	if err != nil {
+		return errors.Join(append(errs, syncError("выборка напоминаний", err))...)
+	}
+	ms := msForSend.getMessages(driver)
+	s.fitMessages(ms)
+	if err := writeMessagesTable(s.cfg.DryRunOutput, s.location, ms); err != nil {
+		errs = append(errs, syncError("вывод сообщений", err))
+	}
+	return errors.Join(errs...)
+}
+
+// Функция копирует файлы хранилища src в каталог dst
+func copyStorage(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), b, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Функция ставит наступившие к моменту t напоминания в очередь и рассчитывает следующие,
+// пока не останется просроченных (например, повторений события за время простоя)
+func (s *Syncer) enqueueDue(t time.Time) error {
+	s.store.Lock()
+	defer s.store.Unlock()
+
+	driver := s.driver
+	for pass := 0; pass < maxCatchUpPasses; pass++ {
+		msForSend, err := driver.getMessagesBefore(t)
+		if err != nil {
+			return syncError("выборка напоминаний", err)
+		}
+		if len(*msForSend.Task) == 0 {
+			break
+		}
+		ms := msForSend.getMessages(driver)
+		s.fitMessages(ms)
+		// ставим сообщения в очередь на отправку
+		if err := s.enqueueMessages(ms, t); err != nil {
+			return syncError("постановка сообщений в очередь", err)
+		}
+		//генерируем новые даты сообщений для будущих отправок
+		if err := genNewMessages(s, driver, msForSend); err != nil {
+			return syncError("расчет новых напоминаний", err)
+		}
+	}
+	return nil
+}
+
+// Функция загружает изменения календаря, пересчитывает его напоминания и возвращает новый токен календаря
+func (s *Syncer) syncCalendar(ctx context.Context, calendarpath string) (string, error) {
+	driver, client := s.driver, s.client
+	s.store.Lock()
+	db, err := driver.getPropsDB(s, calendarpath)
+	s.store.Unlock()
+	if err != nil {
+		return "", syncError("параметры синхронизации "+calendarpath, err)
+	}
+	itempaths, err := client.getCalendarChanges(ctx, calendarpath, db.Token)
+	if err != nil {
+		return "", syncError("получение изменений календаря "+calendarpath, err)
+	}
+	token, err := client.getNewCalendarToken(ctx, calendarpath)
+	if err != nil {
+		return "", syncError("получение токена календаря "+calendarpath, err)
+	}
+	ev, err := itempaths.getEvents(ctx, s)
+	if err != nil {
+		return "", syncError("получение событий "+calendarpath, err)
+	}
+	ms, err := ev.calcMessages(s, db.DateTime)
+	if err != nil {
+		return "", syncError("расчет напоминаний "+calendarpath, err)
+	}
+
+	// изменения календаря загружены, дальше только работа с хранилищем
+	s.store.Lock()
+	defer s.store.Unlock()
+	if err := itempaths.deleteNotActualPathsDB(driver); err != nil {
+		return "", syncError("удаление событий "+calendarpath, err)
+	}
+	// напоминания измененных событий заменяются рассчитанными, у событий без напоминаний удаляются
+	changed := make(map[string]bool)
+	for _, e := range *ev.Events {
+		changed[eventKey(e.Calendar, e.Uid)] = true
+	}
+	if err := driver.replaceTasksDB(changed, *ms.Task); err != nil {
+		return "", syncError("запись напоминаний "+calendarpath, err)
+	}
+
+	// записываем в БД только актуальные Event (с напоминаниями), остальные измененные события удаляются
+	var evActualChanges []event
+outer:
+	for _, e := range *ev.Events {
+		if !e.isForSMS() {
+			continue
+		}
+		for _, m := range *ms.Task {
+			if e.Uid == m.Uid {
+				e.Id = eventKey(e.Calendar, e.Uid)
+				evActualChanges = append(evActualChanges, e)
+				continue outer
+			}
+		}
+	}
+	ev = nil
+
+	if err := driver.replaceEventsDB(changed, evActualChanges); err != nil {
+		return "", syncError("запись событий "+calendarpath, err)
+	}
+	return token, nil
+}
+
+// Функция возвращает время ближайшего запланированного напоминания или повторной отправки из хранилища
+// Второе значение равно false, если напоминаний нет
+func (s *Syncer) NextDue() (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.openDriver(); err != nil {
+		return time.Time{}, false, err
+	}
+	s.store.Lock()
+	defer s.store.Unlock()
+	next, ok, err := s.driver.getNextTaskTime()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	retry, retryOk, err := s.driver.getNextOutboxTime()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if retryOk && (!ok || retry.Before(next)) {
+		next, ok = retry, true
+	}
+	return next, ok, nil
+}
+
+// Функция запускает синхронизацию в режиме демона: опрашивает календарь с интервалом interval
+// и просыпается точно ко времени ближайшего напоминания. Ошибки синхронизации пишутся в журнал и не прерывают работу.
+// Сообщения отправляются независимо от циклов синхронизации, хранилище заблокировано до завершения функции.
+// Начатый цикл синхронизации и начатая отправка всегда доводятся до конца, после отмены ctx функция возвращает nil.
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) error {
+	stop, err := s.startDispatcher(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return run(ctx, interval, s.cfg.Logger, s.Sync, s.NextDue)
+}
+
+// Функция блокирует хранилище и запускает отправку сообщений из очереди независимо от синхронизации
+// Возвращает функцию остановки, которая дожидается завершения отправки и снимает блокировку
+// В режиме проверки (DryRun) сообщения не отправляются, поэтому режим демона недоступен
+func (s *Syncer) startDispatcher(ctx context.Context) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cfg.DryRun {
+		return nil, fmt.Errorf("Режим проверки (DryRun) не поддерживается в режиме демона")
+	}
+
+	if err := s.openDriver(); err != nil {
+		return nil, syncError("инициализация хранилища", err)
+	}
+	unlock, err := lockStorage(s.cfg.StorageName)
+	if err != nil {
+		return nil, syncError("блокировка хранилища", err)
+	}
+	s.store.Lock()
+	err = s.recoverOutbox()
+	s.store.Unlock()
+	if err != nil {
+		s.cfg.Logger.Println(syncError("проверка очереди сообщений", err))
+	}
+	wake := make(chan struct{}, 1)
+	s.held, s.wake = true, wake
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.dispatchLoop(ctx, wake)
+	}()
+	return func() {
+		cancel()
+		<-done
+		s.mu.Lock()
+		s.held, s.wake = false, nil
+		s.mu.Unlock()
+		unlock()
+	}, nil
+}
+
+// Цикл отправки сообщений режима демона: отправляет наступившие сообщения и ждет следующей попытки,
+// новых сообщений в очереди (wake) или отмены ctx
+func (s *Syncer) dispatchLoop(ctx context.Context, wake <-chan struct{}) {
+	for {
+		if err := s.dispatch(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			s.cfg.Logger.Println(syncError("отправка сообщений", err))
+		}
+		wait := dispatchIdle
+		s.store.Lock()
+		next, ok, err := s.driver.getNextOutboxTime()
+		s.store.Unlock()
+		if err != nil {
+			s.cfg.Logger.Println(err)
+		} else if ok {
+			if d := time.Until(next); d < wait {
+				wait = d
+			}
+		}
+		if wait < minRunPause {
+			wait = minRunPause
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Цикл режима демона, общий для Syncer и MultiSyncer
+func run(ctx context.Context, interval time.Duration, logger *log.Logger, sync func(context.Context) error, nextDue func() (time.Time, bool, error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("Интервал опроса должен быть больше нуля")
+	}
+	for {
+		if err := sync(context.WithoutCancel(ctx)); err != nil {
+			logger.Println(err)
+		}
+		wait := interval
+		if next, ok, err := nextDue(); err != nil {
+			logger.Println(err)
+		} else if ok {
+			if d := time.Until(next); d < wait {
+				wait = d
+			}
+		}
+		if wait < minRunPause {
+			wait = minRunPause
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// Функция получает на вход имя, пароль, адрес, имя календаря, локализацию, первый токен (для архивной загрузки),
+// минимальное время (для того, чтобы из-за сбоя времени и отсутствия файла базы данных не сыпались старые СМС),
+// шлюз отправки SMS и запускает однократный процесс синхронизации
+func Sync(username, password, uri, calendarname, location, storagename, firsttoken string, mintime time.Time, sender Sender) error {
+	s, err := NewSyncer(Config{
+		Username:    username,
+		Password:    password,
+		URI:         uri,
+		Calendars:   []string{calendarname},
+		Location:    location,
+		StorageName: storagename,
+		FirstToken:  firsttoken,
+		MinTime:     mintime,
+		Sender:      sender,
+	})
+	if err != nil {
+		return err
+	}
+	return s.Sync(context.Background())
+}
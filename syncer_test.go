@@ -0,0 +1,162 @@
+package caldavsms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Шлюз для тестов: запоминает сообщения и возвращает ошибки из errs по очереди
+type testSender struct {
+	mu   sync.Mutex
+	errs []error
+	sent []sentSMS
+}
+
+// Сообщение, переданное testSender
+type sentSMS struct {
+	Phone string
+	Text  string
+}
+
+func (ts *testSender) Send(ctx context.Context, phone, text string) (*Delivery, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.errs) > 0 {
+		err := ts.errs[0]
+		ts.errs = ts.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	ts.sent = append(ts.sent, sentSMS{Phone: phone, Text: text})
+	return &Delivery{}, nil
+}
+
+func (ts *testSender) messages() []sentSMS {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]sentSMS(nil), ts.sent...)
+}
+
+// Функция возвращает Syncer с хранилищем во временном каталоге; mod изменяет конфигурацию
+func newTestSyncer(t *testing.T, mod func(cfg *Config)) *Syncer {
+	t.Helper()
+	cfg := Config{Location: "UTC", MinTime: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), FirstToken: "token", Calendars: []string{"cal"},
+		StorageName: t.TempDir(), Sender: &testSender{}, Logger: log.New(io.Discard, "", 0)}
+	if mod != nil {
+		mod(&cfg)
+	}
+	s, err := NewSyncer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.openDriver(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSyncDispatchesWhenCalDAVFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	sender := &testSender{}
+	s := newTestSyncer(t, func(cfg *Config) {
+		cfg.URI = srv.URL
+		cfg.Sender = sender
+	})
+	now := time.Now()
+	if err := s.enqueueMessages([]message{{Phone: "89001234567", Text: "Напоминание", Calendar: "cal", Uid: "e", DateTime: now.Add(-time.Minute)}}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	var syncErr *SyncError
+	if err := s.Sync(context.Background()); !errors.As(err, &syncErr) || syncErr.Op != "поиск календаря" {
+		t.Fatalf("ошибка %v, ожидается ошибка поиска календаря", err)
+	}
+	if got := sender.messages(); len(got) != 1 || got[0].Phone != "89001234567" {
+		t.Errorf("отправлены %+v, ожидается сообщение из очереди", got)
+	}
+	if os, _ := s.driver.getOutboxDB(); len(os) != 1 || os[0].State != OutboxSent {
+		t.Errorf("сообщение в очереди %+v, ожидается состояние sent", os)
+	}
+}
+
+// Функция возвращает содержимое файлов каталога
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(b)
+	}
+	return files
+}
+
+func TestSyncDryRunKeepsStorage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	var out bytes.Buffer
+	sender := &testSender{}
+	s := newTestSyncer(t, func(cfg *Config) {
+		cfg.URI = srv.URL
+		cfg.Sender = sender
+		cfg.DryRun = true
+		cfg.DryRunOutput = &out
+	})
+	at := time.Now().Add(-time.Minute).UTC()
+	e := testEvent(t, s, "e", at.Format(datetimeUTCFormat), trigger{Uid: "a", Trigger: "PT0S"})
+	if err := (&events{Events: &[]event{e}}).writeDB(s.driver); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&tasks{Task: &[]task{{Calendar: "cal", Uid: "e", UidTrigger: "a", DateTime: at, Occurrence: at}}}).writeDB(s.driver); err != nil {
+		t.Fatal(err)
+	}
+	// прерванная отправка: обычная синхронизация пометила бы сообщение неотправленным
+	if err := s.driver.writeAllDB([]outbox{{Id: "sending", State: OutboxSending, DateTime: at, Occurrence: at}}); err != nil {
+		t.Fatal(err)
+	}
+	before := readDir(t, s.cfg.StorageName)
+
+	if err := s.Sync(context.Background()); err == nil {
+		t.Error("ошибка CalDAV не возвращена")
+	}
+	if !strings.Contains(out.String(), "89001234567") {
+		t.Errorf("наступившее сообщение не выведено:\n%v", out.String())
+	}
+	if got := sender.messages(); len(got) != 0 {
+		t.Errorf("в режиме проверки отправлены сообщения %+v", got)
+	}
+	after := readDir(t, s.cfg.StorageName)
+	// файл блокировки хранилища создается при любой синхронизации
+	delete(after, ".lock")
+	for name, b := range before {
+		if after[name] != b {
+			t.Errorf("файл хранилища %v изменен", name)
+		}
+	}
+	if len(after) != len(before) {
+		t.Errorf("файлы хранилища до синхронизации %v, после %v", len(before), len(after))
+	}
+}
@@ -0,0 +1,81 @@
+package caldavsms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Адрес Telegram Bot API по умолчанию
+const telegramDefaultAPI = "https://api.telegram.org"
+
+// TelegramSender отправляет сообщения ботом Telegram (метод sendMessage Bot API)
+// Получатель - идентификатор чата или @username канала; пользователь должен сначала написать боту
+type TelegramSender struct {
+	Token string
+	// Адрес Bot API, по умолчанию https://api.telegram.org
+	APIURL string
+	Client *http.Client
+}
+
+// Функция возвращает бота Telegram с токеном token
+func NewTelegramSender(token string) *TelegramSender {
+	return &TelegramSender{Token: token, APIURL: telegramDefaultAPI}
+}
+
+// Ответ Bot API
+type telegramResponse struct {
+	Ok          bool   `json:"ok"`
+	Description string `json:"description"`
+	Result      struct {
+		MessageID int64 `json:"message_id"`
+	} `json:"result"`
+	Parameters struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+func (t *TelegramSender) Send(ctx context.Context, chat, text string) (*Delivery, error) {
+	body, err := json.Marshal(map[string]string{"chat_id": chat, "text": text})
+	if err != nil {
+		return nil, err
+	}
+	api := t.APIURL
+	if api == "" {
+		api = telegramDefaultAPI
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(api, "/")+"/bot"+t.Token+"/sendMessage", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c := t.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		// адрес запроса содержит токен бота
+		return nil, fmt.Errorf("Не удалось выполнить запрос к Telegram Bot API: %v", strings.ReplaceAll(err.Error(), t.Token, "***"))
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	d := &Delivery{Status: resp.StatusCode, Response: string(respBody)}
+	var r telegramResponse
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return d, fmt.Errorf("Некорректный ответ Telegram Bot API (статус %v)", resp.Status)
+	}
+	if !r.Ok {
+		if r.Parameters.RetryAfter > 0 {
+			return d, fmt.Errorf("Telegram Bot API: %v, повтор через %v с", r.Description, r.Parameters.RetryAfter)
+		}
+		return d, fmt.Errorf("Telegram Bot API: %v", r.Description)
+	}
+	d.MessageID = strconv.FormatInt(r.Result.MessageID, 10)
+	return d, nil
+}
@@ -0,0 +1,331 @@
+package caldavsms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+)
+
+// Часовой пояс, описанный в объекте календаря (VTIMEZONE), в виде правила POSIX TZ
+// Используется, если TZID нет в базе часовых поясов
+type timezone struct {
+	Tzid string `json:"tzid"`
+	Rule string `json:"rule"`
+}
+
+// Имена часовых поясов Windows (Outlook, Exchange) и соответствующие им часовые пояса IANA
+var windowsZones = map[string]string{
+	"Dateline Standard Time":          "Etc/GMT+12",
+	"UTC-11":                          "Etc/GMT+11",
+	"Hawaiian Standard Time":          "Pacific/Honolulu",
+	"Alaskan Standard Time":           "America/Anchorage",
+	"Pacific Standard Time (Mexico)":  "America/Tijuana",
+	"Pacific Standard Time":           "America/Los_Angeles",
+	"US Mountain Standard Time":       "America/Phoenix",
+	"Mountain Standard Time (Mexico)": "America/Mazatlan",
+	"Mountain Standard Time":          "America/Denver",
+	"Central America Standard Time":   "America/Guatemala",
+	"Central Standard Time":           "America/Chicago",
+	"Central Standard Time (Mexico)":  "America/Mexico_City",
+	"Canada Central Standard Time":    "America/Regina",
+	"SA Pacific Standard Time":        "America/Bogota",
+	"Eastern Standard Time":           "America/New_York",
+	"Eastern Standard Time (Mexico)":  "America/Cancun",
+	"US Eastern Standard Time":        "America/Indianapolis",
+	"Venezuela Standard Time":         "America/Caracas",
+	"Atlantic Standard Time":          "America/Halifax",
+	"SA Western Standard Time":        "America/La_Paz",
+	"Pacific SA Standard Time":        "America/Santiago",
+	"Newfoundland Standard Time":      "America/St_Johns",
+	"E. South America Standard Time":  "America/Sao_Paulo",
+	"Argentina Standard Time":         "America/Buenos_Aires",
+	"SA Eastern Standard Time":        "America/Cayenne",
+	"Greenland Standard Time":         "America/Godthab",
+	"UTC-02":                          "Etc/GMT+2",
+	"Azores Standard Time":            "Atlantic/Azores",
+	"Cape Verde Standard Time":        "Atlantic/Cape_Verde",
+	"UTC":                             "Etc/UTC",
+	"GMT Standard Time":               "Europe/London",
+	"Greenwich Standard Time":         "Atlantic/Reykjavik",
+	"Morocco Standard Time":           "Africa/Casablanca",
+	"W. Europe Standard Time":         "Europe/Berlin",
+	"Central Europe Standard Time":    "Europe/Budapest",
+	"Romance Standard Time":           "Europe/Paris",
+	"Central European Standard Time":  "Europe/Warsaw",
+	"W. Central Africa Standard Time": "Africa/Lagos",
+	"GTB Standard Time":               "Europe/Bucharest",
+	"Middle East Standard Time":       "Asia/Beirut",
+	"Egypt Standard Time":             "Africa/Cairo",
+	"E. Europe Standard Time":         "Europe/Chisinau",
+	"South Africa Standard Time":      "Africa/Johannesburg",
+	"FLE Standard Time":               "Europe/Kiev",
+	"Israel Standard Time":            "Asia/Jerusalem",
+	"Kaliningrad Standard Time":       "Europe/Kaliningrad",
+	"Libya Standard Time":             "Africa/Tripoli",
+	"Jordan Standard Time":            "Asia/Amman",
+	"Syria Standard Time":             "Asia/Damascus",
+	"Turkey Standard Time":            "Europe/Istanbul",
+	"Arabic Standard Time":            "Asia/Baghdad",
+	"Arab Standard Time":              "Asia/Riyadh",
+	"Belarus Standard Time":           "Europe/Minsk",
+	"Russian Standard Time":           "Europe/Moscow",
+	"E. Africa Standard Time":         "Africa/Nairobi",
+	"Volgograd Standard Time":         "Europe/Volgograd",
+	"Iran Standard Time":              "Asia/Tehran",
+	"Arabian Standard Time":           "Asia/Dubai",
+	"Astrakhan Standard Time":         "Europe/Astrakhan",
+	"Azerbaijan Standard Time":        "Asia/Baku",
+	"Russia Time Zone 3":              "Europe/Samara",
+	"Mauritius Standard Time":         "Indian/Mauritius",
+	"Saratov Standard Time":           "Europe/Saratov",
+	"Georgian Standard Time":          "Asia/Tbilisi",
+	"Caucasus Standard Time":          "Asia/Yerevan",
+	"Afghanistan Standard Time":       "Asia/Kabul",
+	"West Asia Standard Time":         "Asia/Tashkent",
+	"Ekaterinburg Standard Time":      "Asia/Yekaterinburg",
+	"Pakistan Standard Time":          "Asia/Karachi",
+	"India Standard Time":             "Asia/Calcutta",
+	"Sri Lanka Standard Time":         "Asia/Colombo",
+	"Nepal Standard Time":             "Asia/Katmandu",
+	"Central Asia Standard Time":      "Asia/Almaty",
+	"Bangladesh Standard Time":        "Asia/Dhaka",
+	"Omsk Standard Time":              "Asia/Omsk",
+	"Myanmar Standard Time":           "Asia/Rangoon",
+	"SE Asia Standard Time":           "Asia/Bangkok",
+	"Altai Standard Time":             "Asia/Barnaul",
+	"W. Mongolia Standard Time":       "Asia/Hovd",
+	"North Asia Standard Time":        "Asia/Krasnoyarsk",
+	"N. Central Asia Standard Time":   "Asia/Novosibirsk",
+	"Tomsk Standard Time":             "Asia/Tomsk",
+	"China Standard Time":             "Asia/Shanghai",
+	"North Asia East Standard Time":   "Asia/Irkutsk",
+	"Singapore Standard Time":         "Asia/Singapore",
+	"W. Australia Standard Time":      "Australia/Perth",
+	"Taipei Standard Time":            "Asia/Taipei",
+	"Ulaanbaatar Standard Time":       "Asia/Ulaanbaatar",
+	"Transbaikal Standard Time":       "Asia/Chita",
+	"Tokyo Standard Time":             "Asia/Tokyo",
+	"North Korea Standard Time":       "Asia/Pyongyang",
+	"Korea Standard Time":             "Asia/Seoul",
+	"Yakutsk Standard Time":           "Asia/Yakutsk",
+	"Cen. Australia Standard Time":    "Australia/Adelaide",
+	"AUS Central Standard Time":       "Australia/Darwin",
+	"E. Australia Standard Time":      "Australia/Brisbane",
+	"AUS Eastern Standard Time":       "Australia/Sydney",
+	"West Pacific Standard Time":      "Pacific/Port_Moresby",
+	"Tasmania Standard Time":          "Australia/Hobart",
+	"Vladivostok Standard Time":       "Asia/Vladivostok",
+	"Magadan Standard Time":           "Asia/Magadan",
+	"Sakhalin Standard Time":          "Asia/Sakhalin",
+	"Russia Time Zone 10":             "Asia/Srednekolymsk",
+	"Central Pacific Standard Time":   "Pacific/Guadalcanal",
+	"Russia Time Zone 11":             "Asia/Kamchatka",
+	"New Zealand Standard Time":       "Pacific/Auckland",
+	"UTC+12":                          "Etc/GMT-12",
+	"Fiji Standard Time":              "Pacific/Fiji",
+	"Tonga Standard Time":             "Pacific/Tongatapu",
+	"Samoa Standard Time":             "Pacific/Apia",
+}
+
+// Функция возвращает часовой пояс по значению TZID: имени из базы часовых поясов, имени часового пояса Windows
+// или имени с префиксом вида "/mozilla.org/20050126_1/Europe/Moscow". Для пустого значения возвращается локализация из Config
+func (s *Syncer) loadLocation(tzid string) (*time.Location, error) {
+	if tzid == "" {
+		return s.location, nil
+	}
+	if l, err := time.LoadLocation(tzid); err == nil {
+		return l, nil
+	}
+	if name, ok := windowsZones[tzid]; ok {
+		if l, err := time.LoadLocation(name); err == nil {
+			return l, nil
+		}
+	}
+	parts := strings.Split(strings.Trim(tzid, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		if l, err := time.LoadLocation(strings.Join(parts[i:], "/")); err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: неизвестный часовой пояс '%v'", ErrInvalidTime, tzid)
+}
+
+// Функция переводит значение даты/времени свойства события с параметром TZID во время
+// Если часового пояса нет в базе часовых поясов, используется описание VTIMEZONE из объекта календаря
+func (ev *event) toTime(s *Syncer, value, tzid string) (time.Time, error) {
+	if _, err := s.loadLocation(tzid); err != nil {
+		for _, tz := range ev.Timezones {
+			if tz.Tzid == tzid {
+				l, err := tz.location()
+				if err != nil {
+					return time.Time{}, fmt.Errorf("%w: VTIMEZONE '%v': %v", ErrInvalidTime, tzid, err)
+				}
+				return toTimeIn(value, l)
+			}
+		}
+	}
+	return s.toTime(value, tzid)
+}
+
+// Функция возвращает часовой пояс, время в котором определяется правилом POSIX TZ
+func (tz timezone) location() (*time.Location, error) {
+	return time.LoadLocationFromTZData(tz.Tzid, tzdata(tz.Rule))
+}
+
+// Функция формирует данные TZif версии 2 без переходов: время в таком часовом поясе определяется только правилом rule
+func tzdata(rule string) []byte {
+	var b bytes.Buffer
+	// заголовок и данные версии 1, затем версии 2: один тип времени UTC и ни одного перехода
+	for i := 0; i < 2; i++ {
+		b.WriteString("TZif2")
+		b.Write(make([]byte, 15))
+		for _, n := range []uint32{0, 0, 0, 0, 1, 4} {
+			binary.Write(&b, binary.BigEndian, n)
+		}
+		b.Write([]byte{0, 0, 0, 0, 0, 0})
+		b.WriteString("UTC\x00")
+	}
+	b.WriteString("\n" + rule + "\n")
+	return b.Bytes()
+}
+
+// Функция строит правило POSIX TZ по описанию VTIMEZONE
+// Берутся последние по DTSTART составляющие STANDARD и DAYLIGHT; переход на летнее время учитывается,
+// только если обе составляющие повторяются ежегодно без ограничения (RRULE без UNTIL и COUNT)
+func parseVTimezone(c *ical.Component) (timezone, error) {
+	tz := timezone{Tzid: c.Props.Get("TZID").Value}
+	var std, dst *ical.Component
+	var stdStart, dstStart string
+	for _, sub := range c.Children {
+		var dt string
+		if p := sub.Props.Get("DTSTART"); p != nil {
+			dt = p.Value
+		}
+		switch sub.Name {
+		case "STANDARD":
+			if std == nil || dt > stdStart {
+				std, stdStart = sub, dt
+			}
+		case "DAYLIGHT":
+			if dst == nil || dt > dstStart {
+				dst, dstStart = sub, dt
+			}
+		}
+	}
+	if std == nil {
+		std, dst = dst, nil
+	}
+	if std == nil {
+		return tz, fmt.Errorf("нет описания STANDARD или DAYLIGHT")
+	}
+	stdName, stdOffset, err := posixZone(std)
+	if err != nil {
+		return tz, err
+	}
+	tz.Rule = stdName + stdOffset
+	if dst == nil || !isOngoingRule(std) || !isOngoingRule(dst) {
+		return tz, nil
+	}
+	dstName, dstOffset, err := posixZone(dst)
+	if err != nil {
+		return tz, err
+	}
+	start, err := posixTransition(dst)
+	if err != nil {
+		return tz, err
+	}
+	end, err := posixTransition(std)
+	if err != nil {
+		return tz, err
+	}
+	tz.Rule += dstName + dstOffset + "," + start + "," + end
+	return tz, nil
+}
+
+// Функция проверяет, что составляющая VTIMEZONE повторяется ежегодно без ограничения
+func isOngoingRule(c *ical.Component) bool {
+	p := c.Props.Get("RRULE")
+	if p == nil {
+		return false
+	}
+	r := strings.ToUpper(p.Value)
+	return strings.Contains(r, "FREQ=YEARLY") && !strings.Contains(r, "UNTIL=") && !strings.Contains(r, "COUNT=")
+}
+
+// Функция возвращает обозначение и смещение составляющей VTIMEZONE в формате POSIX TZ
+// Смещение в POSIX TZ отсчитывается на запад: UTC+3 записывается как -03:00:00
+func posixZone(c *ical.Component) (string, string, error) {
+	p := c.Props.Get("TZOFFSETTO")
+	if p == nil {
+		return "", "", fmt.Errorf("не задан TZOFFSETTO")
+	}
+	v := strings.TrimSpace(p.Value)
+	if len(v) != 5 && len(v) != 7 || (v[0] != '+' && v[0] != '-') {
+		return "", "", fmt.Errorf("некорректный TZOFFSETTO '%v'", p.Value)
+	}
+	if _, err := strconv.Atoi(v[1:]); err != nil {
+		return "", "", fmt.Errorf("некорректный TZOFFSETTO '%v'", p.Value)
+	}
+	sign := "-"
+	if v[0] == '-' {
+		sign = "+"
+	}
+	seconds := "00"
+	if len(v) == 7 {
+		seconds = v[5:7]
+	}
+	name := v[:3] + v[3:5]
+	if n := c.Props.Get("TZNAME"); n != nil && n.Value != "" && !strings.ContainsAny(n.Value, "<>,") {
+		name = n.Value
+	}
+	return "<" + name + ">", sign + v[1:3] + ":" + v[3:5] + ":" + seconds, nil
+}
+
+// Функция возвращает правило перехода составляющей VTIMEZONE в формате POSIX TZ: Mмесяц.неделя.день/время
+// Время перехода берется из DTSTART, месяц и день недели - из RRULE (BYMONTH, BYDAY, BYMONTHDAY)
+func posixTransition(c *ical.Component) (string, error) {
+	days := map[string]int{"SU": 0, "MO": 1, "TU": 2, "WE": 3, "TH": 4, "FR": 5, "SA": 6}
+	rule := c.Props.Get("RRULE").Value
+	var month, week, monthday int
+	var byday string
+	for _, part := range strings.Split(strings.ToUpper(rule), ";") {
+		name, value, _ := strings.Cut(part, "=")
+		switch name {
+		case "BYMONTH":
+			month, _ = strconv.Atoi(value)
+		case "BYDAY":
+			byday = value
+		case "BYMONTHDAY":
+			first, _, _ := strings.Cut(value, ",")
+			monthday, _ = strconv.Atoi(first)
+		}
+	}
+	if len(byday) < 2 {
+		return "", fmt.Errorf("некорректное правило перехода '%v'", rule)
+	}
+	day, ok := days[byday[len(byday)-2:]]
+	if !ok {
+		return "", fmt.Errorf("некорректное правило перехода '%v'", rule)
+	}
+	switch n := byday[:len(byday)-2]; {
+	case n == "-1":
+		week = 5
+	case n != "":
+		week, _ = strconv.Atoi(strings.TrimPrefix(n, "+"))
+	case monthday > 0:
+		week = (monthday-1)/7 + 1
+	}
+	if month < 1 || month > 12 || week < 1 || week > 5 {
+		return "", fmt.Errorf("некорректное правило перехода '%v'", rule)
+	}
+	at := "02:00:00"
+	if p := c.Props.Get("DTSTART"); p != nil && len(p.Value) >= 15 {
+		at = p.Value[9:11] + ":" + p.Value[11:13] + ":" + p.Value[13:15]
+	}
+	return fmt.Sprintf("M%v.%v.%v/%v", month, week, day, at), nil
+}
@@ -0,0 +1,106 @@
+package caldavsms
+
+import (
+	"sort"
+	"time"
+)
+
+// Upcoming - запланированное сообщение из хранилища
+type Upcoming struct {
+	Account    string    `json:"account"`
+	DateTime   time.Time `json:"datetime"`
+	Phones     []string  `json:"phones"`
+	Text       string    `json:"text"`
+	Calendar   string    `json:"calendar"`
+	Uid        string    `json:"uid"`
+	UidTrigger string    `json:"uidtrigger"`
+	Repeat     int       `json:"repeat"`
+	Occurrence time.Time `json:"occurrence"`
+	Path       string    `json:"path"`
+	// Количество частей SMS текста Text, 0 - среди получателей нет номеров телефонов
+	Segments int `json:"segments"`
+}
+
+// UpcomingFilter - условия выборки запланированных сообщений
+// Пустые поля не ограничивают выборку
+type UpcomingFilter struct {
+	// Номер телефона получателя в любом формате, допустимом в описании события
+	Phone string
+	// UID события
+	Uid string
+	// Интервал времени отправки [From, To)
+	From time.Time
+	To   time.Time
+	// Максимальное количество сообщений
+	Limit int
+}
+
+// Функция возвращает из хранилища запланированные сообщения, отсортированные по времени отправки
+// Время отправки приводится к локализации из Config
+func (s *Syncer) Upcoming(f UpcomingFilter) ([]Upcoming, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.openDriver(); err != nil {
+		return nil, err
+	}
+	s.store.Lock()
+	ts, err := s.driver.getTasksDB()
+	var evs []event
+	if err == nil {
+		evs, err = s.driver.getEventsDB()
+	}
+	s.store.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	byUid := make(map[string]event, len(evs))
+	for _, e := range evs {
+		if e.Rrule != "" || e.Reccurence == "" {
+			byUid[eventKey(e.Calendar, e.Uid)] = e
+		}
+	}
+	phone := parseRecipient(f.Phone)
+	var result []Upcoming
+	for _, t := range ts {
+		if f.Uid != "" && t.Uid != f.Uid {
+			continue
+		}
+		if !f.From.IsZero() && t.DateTime.Before(f.From) {
+			continue
+		}
+		if !f.To.IsZero() && !t.DateTime.Before(f.To) {
+			continue
+		}
+		e, ok := byUid[eventKey(t.Calendar, t.Uid)]
+		if !ok {
+			continue
+		}
+		u := Upcoming{Account: s.cfg.Username, DateTime: t.DateTime.In(s.location), Calendar: t.Calendar, Uid: t.Uid, UidTrigger: t.UidTrigger, Repeat: t.Repeat, Occurrence: t.Occurrence.In(s.location), Path: e.Path}
+		u.Text = e.TextSMS
+		tr, _ := e.trigger(t.UidTrigger)
+		var found, sms bool
+		for _, p := range e.recipients(tr) {
+			u.Phones = append(u.Phones, p.Phone)
+			found = found || p.Phone == phone
+			if channel, _ := channelOf(p.Phone); channel == ChannelSMS {
+				sms = true
+			}
+		}
+		// текст обрезается и делится на части SMS так же, как при отправке, только если среди получателей есть номера телефонов
+		if sms {
+			u.Text, u.Segments = s.fitSMS(u.Text)
+		}
+		if f.Phone != "" && !found {
+			continue
+		}
+		result = append(result, u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].DateTime.Before(result[j].DateTime)
+	})
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[:f.Limit]
+	}
+	return result, nil
+}
@@ -0,0 +1,42 @@
+package caldavsms
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpcomingSegments(t *testing.T) {
+	s := newTestSyncer(t, nil)
+	long := strings.Repeat("a", 200)
+	at := time.Date(2030, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, e := range []event{
+		{Calendar: "cal", Uid: "sms", Description: "SMS: 89001234567, tg:123456: " + long},
+		{Calendar: "cal", Uid: "tg", Description: "SMS: tg:123456, mailto:ivan@example.com: " + long},
+	} {
+		e.Dtstart, e.Exdates, e.Triggers = "20300101T100000Z", &[]exdate{}, &[]trigger{{Uid: "a", Trigger: "PT0S"}}
+		if err := e.calc(s); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&events{Events: &[]event{e}}).writeDB(s.driver); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&tasks{Task: &[]task{{Calendar: "cal", Uid: e.Uid, UidTrigger: "a", DateTime: at, Occurrence: at}}}).writeDB(s.driver); err != nil {
+			t.Fatal(err)
+		}
+	}
+	us, err := s.Upcoming(UpcomingFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]Upcoming)
+	for _, u := range us {
+		got[u.Uid] = u
+	}
+	if u := got["sms"]; u.Segments != 1 || len(u.Text) != 160 || !strings.HasSuffix(u.Text, ">") {
+		t.Errorf("получатели SMS: частей %v, длина текста %v", u.Segments, len(u.Text))
+	}
+	if u := got["tg"]; u.Segments != 0 || strings.TrimSpace(u.Text) != long {
+		t.Errorf("получатели без SMS: частей %v, длина текста %v", u.Segments, len(u.Text))
+	}
+}
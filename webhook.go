@@ -0,0 +1,195 @@
+package caldavsms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// WebhookSender отправляет SMS HTTP-запросом к REST API провайдера
+// Адрес и тело запроса - шаблоны text/template с полями .Phone, .Text и полями MessageInfo (.Uid, .Calendar, .DateTime, ...)
+// и функциями json (значение в JSON) и query (экранирование для адреса), например {"to": {{json .Phone}}, "text": {{json .Text}}}
+type WebhookSender struct {
+	Method string
+	Header http.Header
+	// Авторизация: Bearer-токен или имя пользователя и пароль (Basic)
+	BearerToken string
+	User        string
+	Password    string
+	// Статусы ответа, при которых сообщение считается принятым; по умолчанию 2xx
+	SuccessStatus []int
+	// Путь к значению в JSON-ответе вида "data.status" или "messages.0.status" и значение, при котором сообщение принято;
+	// если значение не задано, поле должно присутствовать и не быть пустым, null или false
+	SuccessPath  string
+	SuccessValue string
+	// Путь к идентификатору сообщения провайдера в JSON-ответе
+	MessageIDPath string
+	Client        *http.Client
+
+	url  *template.Template
+	body *template.Template
+}
+
+// Данные шаблонов запроса WebhookSender
+type webhookData struct {
+	MessageInfo
+	Phone string
+	Text  string
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"query": url.QueryEscape,
+}
+
+// Функция возвращает HTTP-шлюз с шаблонами адреса rawurl и тела body (пустое тело - запрос без тела)
+func NewWebhookSender(method, rawurl, body string) (*WebhookSender, error) {
+	if method == "" {
+		method = http.MethodPost
+	}
+	w := &WebhookSender{Method: strings.ToUpper(method), Header: make(http.Header)}
+	var err error
+	if w.url, err = template.New("url").Funcs(webhookFuncs).Parse(rawurl); err != nil {
+		return nil, fmt.Errorf("Некорректный шаблон адреса HTTP-шлюза: %w", err)
+	}
+	if body != "" {
+		if w.body, err = template.New("body").Funcs(webhookFuncs).Parse(body); err != nil {
+			return nil, fmt.Errorf("Некорректный шаблон тела запроса HTTP-шлюза: %w", err)
+		}
+	}
+	return w, nil
+}
+
+func (w *WebhookSender) Send(ctx context.Context, phone, text string) (*Delivery, error) {
+	info, _ := MessageInfoFromContext(ctx)
+	data := webhookData{MessageInfo: info, Phone: phone, Text: text}
+	var u strings.Builder
+	if err := w.url.Execute(&u, data); err != nil {
+		return nil, fmt.Errorf("Не удалось сформировать адрес запроса: %w", err)
+	}
+	var body io.Reader
+	if w.body != nil {
+		var b bytes.Buffer
+		if err := w.body.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("Не удалось сформировать тело запроса: %w", err)
+		}
+		body = &b
+	}
+	req, err := http.NewRequestWithContext(ctx, w.Method, strings.TrimSpace(u.String()), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range w.Header {
+		req.Header[k] = vs
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if w.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.BearerToken)
+	} else if w.User != "" {
+		req.SetBasicAuth(w.User, w.Password)
+	}
+	c := w.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	d := &Delivery{Status: resp.StatusCode, Response: string(respBody)}
+	if len(d.Response) > 4096 {
+		d.Response = d.Response[:4096]
+	}
+	if !w.successStatus(resp.StatusCode) {
+		return d, fmt.Errorf("HTTP-шлюз вернул статус %v", resp.Status)
+	}
+	if w.SuccessPath == "" && w.MessageIDPath == "" {
+		return d, nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(respBody))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return d, fmt.Errorf("Некорректный JSON-ответ HTTP-шлюза: %v", err)
+	}
+	if w.MessageIDPath != "" {
+		if id, ok := jsonPath(v, w.MessageIDPath); ok && id != nil {
+			d.MessageID = jsonString(id)
+		}
+	}
+	if w.SuccessPath != "" {
+		value, ok := jsonPath(v, w.SuccessPath)
+		if w.SuccessValue != "" && (!ok || jsonString(value) != w.SuccessValue) {
+			return d, fmt.Errorf("HTTP-шлюз не принял сообщение: %v = %v", w.SuccessPath, jsonString(value))
+		}
+		if w.SuccessValue == "" && (!ok || value == nil || value == false || value == "") {
+			return d, fmt.Errorf("HTTP-шлюз не принял сообщение: нет значения %v", w.SuccessPath)
+		}
+	}
+	return d, nil
+}
+
+// Функция проверяет, считается ли статус ответа успешным
+func (w *WebhookSender) successStatus(status int) bool {
+	if len(w.SuccessStatus) == 0 {
+		return status >= 200 && status < 300
+	}
+	for _, s := range w.SuccessStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Функция возвращает значение по пути вида "data.messages.0.id": ключи объектов и индексы массивов через точку
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Функция возвращает значение JSON строкой: строки без кавычек, числа в исходной записи
+func jsonString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(value)
+		return string(b)
+	}
+}
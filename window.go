@@ -0,0 +1,133 @@
+package caldavsms
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeliveryWindow - окно доставки: интервал времени суток [From, To) в дни недели Days
+// Время отсчитывается в локализации из Config, To не больше 24 часов
+type DeliveryWindow struct {
+	Days []time.Weekday
+	From time.Duration
+	To   time.Duration
+}
+
+// WindowPolicy - правило обработки сообщений, наступивших вне окон доставки
+type WindowPolicy int
+
+const (
+	// Откладывать сообщение до открытия ближайшего окна доставки
+	WindowDefer WindowPolicy = iota
+	// Не отправлять сообщение
+	WindowDrop
+)
+
+// Количество дней, в пределах которых ищется открытие окна доставки
+const windowSearchDays = 400
+
+func (p WindowPolicy) String() string {
+	switch p {
+	case WindowDefer:
+		return "defer"
+	case WindowDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("WindowPolicy(%d)", int(p))
+	}
+}
+
+// Функция разбирает правило обработки сообщений вне окон доставки: "defer" или "drop"
+func ParseWindowPolicy(v string) (WindowPolicy, error) {
+	for _, p := range []WindowPolicy{WindowDefer, WindowDrop} {
+		if p.String() == v {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Некорректное правило окон доставки '%v', допустимы defer, drop", v)
+}
+
+// Функция проверяет окна доставки из конфигурации
+func validateWindows(ws []DeliveryWindow) error {
+	for _, w := range ws {
+		if w.From < 0 || w.To > 24*time.Hour || w.From >= w.To {
+			return fmt.Errorf("Некорректное окно доставки %v-%v: начало должно быть раньше окончания в пределах суток", w.From, w.To)
+		}
+		if len(w.Days) == 0 {
+			return fmt.Errorf("Не заданы дни недели окна доставки %v-%v", w.From, w.To)
+		}
+	}
+	return nil
+}
+
+// Функция проверяет, является ли день t праздничным
+func (s *Syncer) isHoliday(t time.Time) bool {
+	y, m, d := t.In(s.location).Date()
+	for _, h := range s.cfg.Holidays {
+		hy, hm, hd := h.Date()
+		if hy == y && hm == m && hd == d {
+			return true
+		}
+	}
+	return false
+}
+
+// Функция возвращает окна доставки дня t, начало и окончание каждого окна
+func (s *Syncer) windowsOfDay(t time.Time) [][2]time.Time {
+	var result [][2]time.Time
+	if s.isHoliday(t) {
+		return nil
+	}
+	day := t.In(s.location)
+	for _, w := range s.cfg.DeliveryWindows {
+		for _, wd := range w.Days {
+			if wd == day.Weekday() {
+				result = append(result, [2]time.Time{atTimeOfDay(day, w.From), atTimeOfDay(day, w.To)})
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Функция возвращает ближайший момент не раньше t, когда открыто окно доставки
+// Если окна доставки не заданы, возвращает t. Второе значение равно false, если окно не открывается в ближайший год.
+func (s *Syncer) nextWindowOpen(t time.Time) (time.Time, bool) {
+	if len(s.cfg.DeliveryWindows) == 0 {
+		return t, true
+	}
+	day := t.In(s.location)
+	for i := 0; i < windowSearchDays; i++ {
+		var next time.Time
+		for _, w := range s.windowsOfDay(day) {
+			if !t.Before(w[0]) && t.Before(w[1]) {
+				return t, true
+			}
+			if w[0].After(t) && (next.IsZero() || w[0].Before(next)) {
+				next = w[0]
+			}
+		}
+		if !next.IsZero() {
+			return next, true
+		}
+		day = atTimeOfDay(day.AddDate(0, 0, 1), 0)
+	}
+	return time.Time{}, false
+}
+
+// Функция проверяет, можно ли отправить сообщение в момент t
+// Если момент вне окон доставки, возвращает время, до которого сообщение откладывается
+// (нулевое - сообщение не отправляется), и причину
+func (s *Syncer) windowDecision(t time.Time) (bool, time.Time, string) {
+	open, ok := s.nextWindowOpen(t)
+	if ok && !open.After(t) {
+		return true, time.Time{}, ""
+	}
+	if !ok {
+		return false, time.Time{}, "вне окон доставки, окно не открывается в ближайший год"
+	}
+	if s.cfg.WindowPolicy == WindowDrop {
+		return false, time.Time{}, "вне окон доставки"
+	}
+	return false, open, fmt.Sprintf("вне окон доставки, отложено до %v", open.In(s.location).Format("2006-01-02 15:04"))
+}